@@ -3,14 +3,20 @@ package main
 import (
 	"context"
 	"errors"
+	"math"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// smallest part size that users can choose
+const minPartSize int64 = 1024 * 1024
+
 // maxPartSize ::= <number>[b|k|m|g]
-func SplitFileToParts(ctx context.Context, filePath, outPath, maxPartSize string) ([]string, error) {
+// Archive is encrypted (including the file names) if `password` is not empty.
+func SplitFileToParts(ctx context.Context, filePath, outPath, maxPartSize, password string) ([]string, error) {
 	if !strings.HasSuffix(outPath, ".7z") {
 		return nil, errors.New("output path must be a file path with .7z extention")
 	}
@@ -18,26 +24,17 @@ func SplitFileToParts(ctx context.Context, filePath, outPath, maxPartSize string
 	cmdCtx, cmdCancel := context.WithTimeout(ctx, time.Minute*15)
 	defer cmdCancel()
 
-	args := []string{"a", "-t7z", "-m0=lzma2", "-mx=1", "-v" + maxPartSize, "-sdel", outPath, filePath}
-	errChan := make(chan error, 1)
-	go func() {
-		cmd := exec.Command("7zz", args...)
-		err := cmd.Start()
-		if err != nil {
-			errChan <- err
-			return
-		}
-		err = cmd.Wait()
-		errChan <- err
-	}()
-
-	select {
-	case err := <-errChan:
-		if err != nil {
-			return nil, err
-		}
-	case <-cmdCtx.Done():
-		return nil, cmdCtx.Err()
+	args := []string{"a", "-t7z", "-m0=lzma2", "-mx=1", "-v" + maxPartSize, "-sdel"}
+	input := ""
+	if password != "" {
+		// arguments of processes can be read by other users, so 7zz asks for the
+		// password and reads it from stdin, twice if it verifies the password
+		args = append(args, "-p", "-mhe=on")
+		input = password + "\n" + password + "\n"
+	}
+	args = append(args, outPath, filePath)
+	if _, err := run7zzWithInput(cmdCtx, input, args...); err != nil {
+		return nil, err
 	}
 
 	outDir := filepath.Dir(outPath)
@@ -48,3 +45,100 @@ func SplitFileToParts(ctx context.Context, filePath, outPath, maxPartSize string
 
 	return files, nil
 }
+
+// Returns the total size of files in the archive, as listed by 7zz.
+func ArchiveContentSize(ctx context.Context, archivePath string) (int64, error) {
+	cmdCtx, cmdCancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cmdCancel()
+
+	out, err := run7zz(cmdCtx, "l", "-slt", archivePath)
+	if err != nil {
+		return 0, err
+	}
+	// archive's own properties come before the separator
+	_, entries, ok := strings.Cut(string(out), "\n----------\n")
+	if !ok {
+		return 0, nil
+	}
+	var size int64
+	for line := range strings.SplitSeq(entries, "\n") {
+		if v, ok := strings.CutPrefix(line, "Size = "); ok {
+			n, _ := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			size += n
+		}
+	}
+	return size, nil
+}
+
+// Extracts the archive into `outDir`. Encrypted archives fail, since there is
+// no one to enter the password.
+func ExtractArchive(ctx context.Context, archivePath, outDir string) error {
+	cmdCtx, cmdCancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cmdCancel()
+
+	_, err := run7zz(cmdCtx, "x", "-y", "-o"+outDir, archivePath)
+	return err
+}
+
+// Runs 7zz and returns its output. The process is killed when `ctx` is done.
+func run7zz(ctx context.Context, args ...string) ([]byte, error) {
+	return run7zzWithInput(ctx, "", args...)
+}
+
+// Like run7zz, with `input` written to stdin of 7zz.
+func run7zzWithInput(ctx context.Context, input string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "7zz", args...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return out, err
+}
+
+// Options of the 7z archive that the job's file is uploaded in.
+type archiveOptions struct {
+	password string
+	// size of archive parts. Zero means `filePartSize`.
+	partSize int64
+}
+
+// Files must be archived even if they are small enough to be uploaded as is.
+func (o archiveOptions) required() bool {
+	return o.password != "" || o.partSize > 0
+}
+
+func (o archiveOptions) partSizeArg() string {
+	if o.partSize > 0 {
+		return strconv.FormatInt(o.partSize, 10) + "b"
+	}
+	return strconv.FormatInt(filePartSize, 10) + "b"
+}
+
+// Parses part sizes in <number>[k|m|g] form (e.g. "50m"). Units are powers of 1024
+// like 7z's -v switch.
+func parsePartSize(s string) (int64, error) {
+	size, ok := parseByteSize(s)
+	if !ok || size > filePartSize || size < minPartSize {
+		return 0, ErrInvalidPartSize
+	}
+	return size, nil
+}
+
+// Parses sizes in <number>[k|m|g|t] form. Units are powers of 1024.
+func parseByteSize(s string) (int64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for i, unit := range []string{"k", "m", "g", "t"} {
+		if strings.HasSuffix(s, unit) {
+			multiplier = int64(1) << (10 * (i + 1))
+			s = s[:len(s)-1]
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/multiplier {
+		return 0, false
+	}
+	return n * multiplier, true
+}
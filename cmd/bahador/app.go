@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/thehxdev/bahador/db"
@@ -21,24 +25,55 @@ import (
 )
 
 const (
-	maxFileSize  int64  = 4 * 1024 * 1024 * 1024
-	filePartSize int64  = 200 * 1024 * 1024
-	workersCount int    = 5
-	tokenEnvVar  string = "BAHADOR_BOT_TOKEN"
-	hostEnvVar   string = "BAHADOR_BOT_HOST"
-	dbPathEnvVar string = "BAHADOR_DB_PATH"
+	maxFileSize    int64  = 4 * 1024 * 1024 * 1024
+	filePartSize   int64  = 200 * 1024 * 1024
+	defaultWorkers int    = 5
+	tokenEnvVar    string = "BAHADOR_BOT_TOKEN"
+	hostEnvVar     string = "BAHADOR_BOT_HOST"
+	dbPathEnvVar   string = "BAHADOR_DB_PATH"
+	secretEnvVar   string = "BAHADOR_SECRET_KEY"
+	// size of files that the server does not report their length
+	unknownFileSize int64 = -1
+	// attempts to upload a file or part. Rate limited attempts are not counted.
+	uploadAttempts   int = 4
+	uploadRetryDelay     = 5 * time.Second
 )
 
 type jobResult struct {
 	error
 	fileIds []string
+	// job was paused and can be resumed from its progress
+	paused bool
 }
 
 type dlJob struct {
+	// id of the job's entry, set when the job runs
+	id          int64
+	userId      int
 	url         string
+	header      http.Header
+	proxy       *url.URL
+	fileName    string
+	archive     archiveOptions
+	extract     bool
+	source      Source
+	progress    *jobProgress
 	resChan     chan jobResult
 	cancelChan  chan struct{}
+	pauseChan   chan struct{}
 	eventLogger func(string, ...any)
+	// name and size of the file that the source gave when the job was queued
+	info *sourceInfo
+	// asks the user a question while the job is running. It's nil if the job
+	// can't ask questions.
+	ask func(ctx context.Context, question string) (string, error)
+	// scheduled jobs start at this time and are created again from their links
+	// message when they are due
+	startAt time.Time
+	message string
+	// answer to the question of the source, which is not asked again when the
+	// job is created from its message
+	answer string
 }
 
 type App struct {
@@ -46,8 +81,43 @@ type App struct {
 	DB  *db.DB
 	Log *log.Logger
 
-	jobChan chan dlJob
-	jobMap  map[int64](chan struct{})
+	httpClient      *http.Client
+	globalProxy     *url.URL
+	proxyRules      proxyRuleSet
+	blockedPrefixes []netip.Prefix
+
+	jobQueue *jobQueue
+	jobMu    sync.Mutex
+	jobMap   map[int64]*jobEntry
+	// users whose jobs run before jobs of other users, except admins
+	priorityUsers map[int]bool
+	// runJob calls, which save and send the results of jobs after workers stop
+	jobWg sync.WaitGroup
+
+	// workers run until this context is done
+	ctx         context.Context
+	workerMu    sync.Mutex
+	workerStops []context.CancelFunc
+	workerWg    sync.WaitGroup
+	limits      jobLimits
+	disk        *diskBudget
+	// nil if caching is disabled
+	cache     *fileCache
+	bandwidth *bandwidthLimits
+	storage   Storage
+	// nil if the file server is disabled
+	files *fileServer
+	// set when the bot is shutting down and does not accept new jobs
+	closing atomic.Bool
+
+	// key used to encrypt sensitive data stored in database
+	secretKey []byte
+
+	// torrents are downloaded with aria2c and media sites with yt-dlp, which are optional
+	torrentEnabled bool
+	mediaEnabled   bool
+	// links of sites that aren't in the media hosts are checked with yt-dlp
+	mediaDetect bool
 }
 
 func AppNew(ctx context.Context) (*App, error) {
@@ -66,96 +136,185 @@ func AppNew(ctx context.Context) (*App, error) {
 	}
 	if createNewDB {
 		db.Log.Println("creating new databse:", databasePath)
-		if err := db.Setup(dbSchemaPath); err != nil {
-			panic(err)
-		}
+	}
+	// schema only creates missing tables, so it's safe to apply it on every start.
+	if err := db.Setup(dbSchemaPath); err != nil {
+		panic(err)
 	}
 
 	a := &App{
-		DB:      db,
-		Log:     log.New(os.Stderr, "[bahador] ", log.Ldate|log.Lshortfile),
-		jobChan: make(chan dlJob, workersCount),
-		jobMap:  make(map[int64]chan struct{}),
+		DB:       db,
+		Log:      log.New(os.Stderr, "[bahador] ", log.Ldate|log.Lshortfile),
+		ctx:      ctx,
+		jobQueue: newJobQueue(),
+		jobMap:   make(map[int64]*jobEntry),
+
+		secretKey: []byte(os.Getenv(secretEnvVar)),
 	}
 
-	for range workersCount {
-		go a.worker(ctx)
+	if _, err := exec.LookPath("aria2c"); err == nil {
+		a.torrentEnabled = true
+	} else {
+		a.Log.Println("aria2c command not found, torrent downloads are disabled")
+	}
+	if _, err := exec.LookPath("yt-dlp"); err == nil {
+		a.mediaEnabled = true
+		if a.mediaDetect, err = loadMediaDetect(); err != nil {
+			return nil, err
+		}
+	} else {
+		a.Log.Println("yt-dlp command not found, media extraction is disabled")
 	}
 
+	a.httpClient, err = a.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	a.priorityUsers, err = loadPriorityUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	a.limits, err = loadJobLimits()
+	if err != nil {
+		return nil, err
+	}
+	a.disk, err = loadDiskBudget()
+	if err != nil {
+		return nil, err
+	}
+	a.cache, err = loadFileCache(a.disk)
+	if err != nil {
+		return nil, err
+	}
+	a.bandwidth, err = loadBandwidthLimits()
+	if err != nil {
+		return nil, err
+	}
+	a.storage, err = a.loadStorage()
+	if err != nil {
+		return nil, err
+	}
+	a.files, err = a.loadFileServer()
+	if err != nil {
+		return nil, err
+	}
+	a.disk.onRelease = a.jobQueue.wake
+	a.jobQueue.fits, a.jobQueue.admit = a.jobDiskFits, a.reserveJobDisk
+	workers, err := envPositiveInt(workersEnvVar, defaultWorkers)
+	if err != nil {
+		return nil, err
+	}
+	a.setWorkersCount(workers)
+
 	return a, nil
 }
 
-func (app *App) worker(ctx context.Context) {
+// Jobs run with `ctx`. The worker stops when `stopCtx` is done, after its current job.
+func (app *App) worker(ctx, stopCtx context.Context) {
 	for {
-		select {
-		case <-ctx.Done():
+		job, ok := app.jobQueue.pop(stopCtx)
+		if !ok {
 			return
-		default:
 		}
 
-		job := <-app.jobChan
-		logEvent := job.eventLogger
-
+		jobCtx, jobCancel := context.WithCancelCause(withJobUser(withJobProxy(ctx, job.proxy), job.userId))
 		res := func() jobResult {
 			// app.Log.Println("processing job:", job.url)
 
-			jobCtx, jobCancel := context.WithCancel(ctx)
-			defer jobCancel()
-
 			go func() {
-				<-job.cancelChan
-				jobCancel()
+				select {
+				case <-job.cancelChan:
+					jobCancel(context.Canceled)
+				case <-job.pauseChan:
+					jobCancel(ErrJobPaused)
+				case <-jobCtx.Done():
+				}
 			}()
 
 			app.Log.Println("Getting remote file information")
-			fname, fsize, err := getRemoteFileInfo(jobCtx, job.url)
+			fname, fsize, err := job.sourceInfo(jobCtx)
 			if err != nil {
 				return jobResult{error: err}
 			}
+			app.Log.Printf("Remote file: %s (%d bytes)\n", fname, fsize)
 
 			if fsize > maxFileSize {
 				return jobResult{error: ErrMaxFileSize}
 			}
 
 			var result jobResult
-			if fsize <= filePartSize {
-				app.Log.Println("Processing job with pipe")
-				result = app.processJobWithPipe(jobCtx, fname, fsize, job.url, logEvent)
-			} else {
-				app.Log.Println("Processing job with download")
-				result = app.processJobWithDownload(jobCtx, fname, fsize, job.url, logEvent)
+			switch src := job.source.(type) {
+			case Fetcher:
+				app.Log.Println("Processing job with fetch")
+				result = app.processJobWithFetch(jobCtx, src, job)
+			case Opener:
+				if app.pipedJob(job, fsize) {
+					app.Log.Println("Processing job with pipe")
+					result = app.processJobWithPipe(jobCtx, src, fsize, job)
+				} else {
+					app.Log.Println("Processing job with download")
+					result = app.processJobWithDownload(jobCtx, src, fsize, job)
+				}
 			}
 
 			return result
 		}()
 
+		switch {
+		case res.error != nil && errors.Is(context.Cause(jobCtx), ErrJobPaused):
+			res = jobResult{paused: true}
+		case errors.Is(res.error, ErrIncompleteUpload):
+			// retries of the job continue with the parts that are not uploaded
+		default:
+			job.progress.remove()
+		}
+		jobCancel(nil)
+		// the state is set before the result is sent, so shutdown knows which
+		// jobs have stopped after the workers return
+		if res.paused {
+			app.setJobState(job.id, jobPaused)
+		} else {
+			app.setJobState(job.id, jobFinished)
+		}
 		job.resChan <- res
 	}
 }
 
-func (app *App) processJobWithPipe(ctx context.Context, fname string, fsize int64, url string, logEvent func(string, ...any)) (res jobResult) {
-	if fname == "" {
-		res.error = ErrEmptyFileName
-		return
+// Small files are piped from the source to the storage. Archives must be saved
+// to be extracted, and files that can be cached are saved for the cache, which
+// also serves the ones that are cached.
+func (app *App) pipedJob(job dlJob, fsize int64) bool {
+	if _, ok := job.source.(Opener); !ok {
+		return false
 	}
+	return !job.extract && fsize != unknownFileSize && fsize <= filePartSize && app.jobCacheKey(job) == ""
+}
 
+func (app *App) processJobWithPipe(ctx context.Context, src Opener, fsize int64, job dlJob) (res jobResult) {
 	res.error = func() error {
 		pCtx, pCancel := context.WithTimeout(ctx, time.Minute*30)
 		defer pCancel()
 
-		dlReq, err := http.NewRequestWithContext(pCtx, "GET", url, nil)
-		if err != nil {
+		// slots are always taken in download, archiver, upload order
+		if err := app.limits.downloads.acquire(pCtx); err != nil {
 			return err
 		}
+		defer app.limits.downloads.release()
+		if err := app.limits.uploads.acquire(pCtx); err != nil {
+			return err
+		}
+		defer app.limits.uploads.release()
 
-		dlResp, err := http.DefaultClient.Do(dlReq)
+		body, fname, err := src.Open(pCtx, 0)
 		if err != nil {
 			return err
 		}
-		defer dlResp.Body.Close()
+		defer body.Close()
 
-		if dlResp.StatusCode != http.StatusOK {
-			return ErrNonZeroStatusCode
+		fname = job.fileNameOr(fname)
+		if fname == "" {
+			return ErrEmptyFileName
 		}
 
 		errChan := make(chan error, 2)
@@ -165,10 +324,10 @@ func (app *App) processJobWithPipe(ctx context.Context, fname string, fsize int6
 			pipeReader.Close()
 		}()
 
-		logEvent("Processing download and upload with pipe")
+		job.eventLogger("Processing download and upload with pipe")
 
 		go func() {
-			n, err := io.Copy(pipeWriter, dlResp.Body)
+			n, err := io.Copy(pipeWriter, app.rateLimited(pCtx, false, body))
 			if err != nil {
 				goto ret
 			}
@@ -181,22 +340,11 @@ func (app *App) processJobWithPipe(ctx context.Context, fname string, fsize int6
 		}()
 
 		go func() {
-			uparams := telbot.UploadParams{
-				ChatId: app.Bot.Self.Id,
-				Method: "sendDocument",
-			}
-			files := []telbot.IFileInfo{
-				&telbot.FileReader{
-					Reader:   pipeReader,
-					Kind:     "document",
-					FileName: fname,
-				},
-			}
-			msg, err := app.Bot.UploadFile(pCtx, uparams, files)
+			fileId, err := app.storage.Upload(pCtx, fname, app.rateLimited(pCtx, true, pipeReader), fsize)
 			if err != nil {
 				pipeReader.CloseWithError(err)
 			} else {
-				res.fileIds = []string{msg.Document.FileId}
+				res.fileIds = []string{fileId}
 			}
 			errChan <- err
 		}()
@@ -218,152 +366,454 @@ func (app *App) processJobWithPipe(ctx context.Context, fname string, fsize int6
 	return
 }
 
-func (app *App) processJobWithDownload(ctx context.Context, fname string, fsize int64, url string, logEvent func(string, ...any)) (res jobResult) {
-	tmpDir, err := os.MkdirTemp(os.TempDir(), "bahador_*")
+func (app *App) processJobWithDownload(ctx context.Context, src Opener, fsize int64, job dlJob) (res jobResult) {
+	logEvent := job.eventLogger
+	progress := job.progress
+
+	tmpDir, err := progress.dir()
 	if err != nil {
 		res.error = err
 		return
 	}
-	defer os.RemoveAll(tmpDir)
 
 	app.Log.Println("tmp dir:", tmpDir)
 
 	pCtx, pCancel := context.WithTimeout(ctx, time.Minute*90)
 	defer pCancel()
 
-	fileDlPath := filepath.Join(tmpDir, fname)
-	app.Log.Println("File download path:", fileDlPath)
-	logEvent("Downloading the file...")
-
-	err = app.downloadAndSaveFile(pCtx, fileDlPath, fsize, url)
-	if err != nil {
-		res.error = err
-		return
+	if !progress.downloaded && app.loadCachedFile(tmpDir, job) {
+		app.Log.Println("File is loaded from cache:", progress.filePath)
+	}
+	if !progress.downloaded {
+		logEvent("Downloading the file...")
+		var (
+			fileDlPath string
+			dlSize     int64
+		)
+		err := withLimit(pCtx, app.limits.downloads, func() (err error) {
+			fileDlPath, dlSize, err = app.downloadAndSaveFile(pCtx, tmpDir, src, fsize, job)
+			return
+		})
+		if err != nil {
+			res.error = err
+			return
+		}
+		progress.filePath, progress.fileSize, progress.downloaded = fileDlPath, dlSize, true
+		if app.cache != nil && progress.cacheKey != "" {
+			if err := app.cache.putFile(progress.cacheKey, fileDlPath); err != nil {
+				app.Log.Println(err)
+			}
+		}
 	}
 
-	archivePath := filepath.Join(tmpDir, fname+".7z")
-	app.Log.Println("Archive path:", archivePath)
-	logEvent("Creating archive files...")
-	parts, err := SplitFileToParts(ctx, fileDlPath, archivePath, "200m")
+	return app.uploadLocalFile(pCtx, tmpDir, progress.filePath, progress.fileSize, job)
+}
+
+// Fetchers continue from the files that they left in the directory, when the job
+// is resumed.
+func (app *App) processJobWithFetch(ctx context.Context, src Fetcher, job dlJob) (res jobResult) {
+	logEvent := job.eventLogger
+	progress := job.progress
+
+	tmpDir, err := progress.dir()
 	if err != nil {
 		res.error = err
 		return
 	}
-	// app.Log.Printf("parts: %#v\n", parts)
 
-	partsCount := len(parts)
-	fileIdChan := make(chan string, partsCount)
+	app.Log.Println("tmp dir:", tmpDir)
 
-	logEvent("Uploading %d parts...", partsCount)
-	for _, p := range parts {
-		go func(pPath string) {
-			var fileId string = ""
-			defer func() { fileIdChan <- fileId }()
-			f, err := os.Open(pPath)
-			if err != nil {
+	pCtx, pCancel := context.WithTimeout(ctx, time.Minute*90)
+	defer pCancel()
+
+	if !progress.downloaded {
+		logEvent("Downloading...")
+		var fpath string
+		err := withLimit(pCtx, app.limits.downloads, func() (err error) {
+			fpath, err = src.Fetch(pCtx, tmpDir)
+			return
+		})
+		if err != nil {
+			res.error = err
+			return
+		}
+
+		if job.fileName != "" {
+			newPath := filepath.Join(filepath.Dir(fpath), job.fileName)
+			if err := os.Rename(fpath, newPath); err != nil {
+				res.error = err
 				return
 			}
-			defer f.Close()
-			uparams := telbot.UploadParams{
-				ChatId: app.Bot.Self.Id,
-				Method: "sendDocument",
+			fpath = newPath
+		}
+
+		// directories are always archived
+		fsize := unknownFileSize
+		stat, err := os.Stat(fpath)
+		if err != nil {
+			res.error = err
+			return
+		}
+		if stat.Mode().IsRegular() {
+			fsize = stat.Size()
+			if fsize > maxFileSize {
+				res.error = ErrMaxFileSize
+				return
 			}
-			app.Log.Println("Uploading file:", pPath)
-			files := []telbot.IFileInfo{
-				&telbot.FileReader{
-					Reader:   f,
-					FileName: filepath.Base(pPath),
-					Kind:     "document",
-				},
+		}
+		progress.filePath, progress.fileSize, progress.downloaded = fpath, fsize, true
+	}
+
+	return app.uploadLocalFile(pCtx, tmpDir, progress.filePath, progress.fileSize, job)
+}
+
+// Uploads a file or directory from `tmpDir`. Files that are small enough are uploaded
+// as is (unless the job has archive options) and everything else is archived into
+// 7z parts first.
+func (app *App) uploadLocalFile(ctx context.Context, tmpDir, fpath string, fsize int64, job dlJob) (res jobResult) {
+	if job.extract {
+		return app.uploadExtracted(ctx, tmpDir, fpath, job)
+	}
+
+	logEvent := job.eventLogger
+	progress := job.progress
+	if app.uploadedWhole(job, fsize) {
+		logEvent("Uploading the file...")
+		fileId, err := app.uploadFileWithRetry(ctx, fpath)
+		if err != nil {
+			res.error = err
+			return
+		}
+		res.fileIds = []string{fileId}
+		return
+	}
+
+	archivePath := filepath.Join(tmpDir, filepath.Base(fpath)+".7z")
+	parts, ok := progress.parts[archivePath]
+	if !ok {
+		app.Log.Println("Archive path:", archivePath)
+		logEvent("Creating archive files...")
+		// parts of an interrupted 7zz run
+		if stale, _ := filepath.Glob(filepath.Join(tmpDir, "*.7z.*")); len(stale) > 0 {
+			for _, p := range stale {
+				os.Remove(p)
 			}
-			msg, err := app.Bot.UploadFile(pCtx, uparams, files)
-			if err != nil {
-				return
+		}
+		err := withLimit(ctx, app.limits.archivers, func() (err error) {
+			parts, err = SplitFileToParts(ctx, fpath, archivePath, job.archive.partSizeArg(), job.archive.password)
+			return
+		})
+		if err != nil {
+			res.error = err
+			return
+		}
+		progress.parts[archivePath] = parts
+		// parts of password protected archives are not shared
+		if app.cache != nil && progress.cacheKey != "" && job.archive.password == "" {
+			partsDir := cachePartsDir(filepath.Base(fpath), job.archive.partSizeArg())
+			if err := app.cache.putParts(progress.cacheKey, partsDir, parts); err != nil {
+				app.Log.Println(err)
 			}
-			fileId = msg.Document.FileId
-		}(p)
+		}
 	}
+	// app.Log.Printf("parts: %#v\n", parts)
 
-	fileIds := []string{}
-	for range partsCount {
+	type uploadResult struct {
+		path   string
+		fileId string
+		err    error
+	}
+	// parts that were uploaded before the job was paused are skipped
+	remaining := []string{}
+	for _, p := range parts {
+		if _, ok := progress.uploaded[p]; !ok {
+			remaining = append(remaining, p)
+		}
+	}
+	fileIdChan := make(chan uploadResult, len(remaining))
+	pathChan := make(chan string, len(remaining))
+	for _, p := range remaining {
+		pathChan <- p
+	}
+	close(pathChan)
+
+	// stops the uploaders if a part fails
+	upCtx, upCancel := context.WithCancel(ctx)
+	defer upCancel()
+
+	logEvent("Uploading %d parts...", len(remaining))
+	for range min(len(remaining), partUploadsPerJob) {
+		go func() {
+			for pPath := range pathChan {
+				fileId, err := app.uploadFileWithRetry(upCtx, pPath)
+				fileIdChan <- uploadResult{pPath, fileId, err}
+			}
+		}()
+	}
+
+	for range remaining {
 		select {
-		case id := <-fileIdChan:
-			if id == "" {
-				// FIXME: this error must be `ErrIncompleteUpload`
-				res.error = ErrIncompleteDownload
+		case r := <-fileIdChan:
+			if r.err != nil {
+				res.error = r.err
 				return
 			}
-			fileIds = append(fileIds, id)
-		case <-pCtx.Done():
-			res.error = pCtx.Err()
+			progress.uploaded[r.path] = r.fileId
+		case <-ctx.Done():
+			res.error = ctx.Err()
 			return
 		}
 	}
 
+	fileIds := []string{}
+	for _, p := range parts {
+		fileIds = append(fileIds, progress.uploaded[p])
+	}
 	res.fileIds = fileIds
 	return
 }
 
-func getFileName(resp *http.Response) string {
-	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
-		if _, params, err := mime.ParseMediaType(cd); err == nil {
-			if fname, ok := params["filename"]; ok && fname != "" {
-				return fname
+// Retries failed uploads with increasing delays. Rate limited uploads wait as long
+// as Bot API asks and are not counted as failures. `ErrIncompleteUpload` is
+// returned if all attempts fail.
+func (app *App) uploadFileWithRetry(ctx context.Context, fpath string) (string, error) {
+	delay := uploadRetryDelay
+	for attempt := 1; ; {
+		fileId, err := app.uploadFile(ctx, fpath)
+		if err == nil {
+			return fileId, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		wait, rateLimited := retryAfter(err)
+		if !rateLimited {
+			if attempt == uploadAttempts {
+				app.Log.Println(err)
+				return "", ErrIncompleteUpload
 			}
+			attempt++
+			wait = delay
+			delay *= 2
 		}
-	}
-	if resp.Request != nil && resp.Request.URL != nil {
-		fname := path.Base(resp.Request.URL.Path)
-		if fname != "." && fname != "/" {
-			return fname
+		app.Log.Printf("Upload of %s failed, retrying in %s: %v\n", filepath.Base(fpath), wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", ctx.Err()
 		}
 	}
-	return ""
 }
 
-func getRemoteFileInfo(ctx context.Context, fileUrl string) (fname string, fsize int64, err error) {
-	req, err := http.NewRequestWithContext(ctx, "HEAD", fileUrl, nil)
+// Returns how long Bot API asked to wait, if the error is a "Too Many Requests"
+// error (e.g. "Too Many Requests: retry after 35").
+func retryAfter(err error) (time.Duration, bool) {
+	_, after, ok := strings.Cut(err.Error(), "retry after ")
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(strings.TrimSpace(after))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds)*time.Second + time.Second, true
+}
+
+func (app *App) uploadFile(ctx context.Context, fpath string) (string, error) {
+	if err := app.limits.uploads.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer app.limits.uploads.release()
+
+	f, err := os.Open(fpath)
 	if err != nil {
-		return
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	app.Log.Println("Uploading file:", fpath)
+	return app.storage.Upload(ctx, filepath.Base(fpath), app.rateLimited(ctx, true, f), stat.Size())
+}
+
+// Files are archived in parts if the archive options need it or the storage
+// can't take them whole.
+func (app *App) uploadedWhole(job dlJob, fsize int64) bool {
+	if job.archive.required() || fsize == unknownFileSize {
+		return false
 	}
+	maxSize := app.storage.MaxFileSize()
+	return maxSize == 0 || fsize <= maxSize
+}
+
+// Names that users set take precedence over the name that source opened. The
+// name from `Source.Open` is used instead of the one from `Source.Info`, since
+// for example HTTP requests of them may follow different redirect chains.
+func (job *dlJob) fileNameOr(fname string) string {
+	if job.fileName != "" {
+		return job.fileName
+	}
+	return fname
+}
+
+func newRequest(ctx context.Context, method, url string, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	return req, nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// Information about a remote file. ETag and Last-Modified headers are empty if
+// server does not send them.
+type remoteFileInfo struct {
+	name         string
+	size         int64
+	etag         string
+	lastModified string
+}
+
+func (app *App) getRemoteFileInfo(ctx context.Context, fileUrl string, header http.Header) (info remoteFileInfo, err error) {
+	req, err := newRequest(ctx, "HEAD", fileUrl, header)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
 
-	fsize, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	resp, err := app.httpClient.Do(req)
 	if err != nil {
 		return
 	}
+	resp.Body.Close()
 
-	fname = getFileName(resp)
+	// Some servers reject HEAD requests or do not send Content-Length header
+	// in their response. Ask for the first byte of the file instead.
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return app.getRemoteFileInfoWithRange(ctx, fileUrl, header)
+	}
+
+	info = newRemoteFileInfo(resp)
+	info.size = resp.ContentLength
 	return
 }
 
-func (app *App) downloadAndSaveFile(ctx context.Context, fpath string, fsize int64, fileUrl string) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+func (app *App) getRemoteFileInfoWithRange(ctx context.Context, fileUrl string, header http.Header) (info remoteFileInfo, err error) {
+	req, err := newRequest(ctx, "GET", fileUrl, header)
 	if err != nil {
-		return err
+		return
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := app.httpClient.Do(req)
 	if err != nil {
-		return err
+		return
 	}
 	defer resp.Body.Close()
-	f, err := os.Create(fpath)
+
+	info = newRemoteFileInfo(resp)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		info.size = parseContentRangeSize(resp.Header.Get("Content-Range"))
+	case http.StatusOK:
+		// server ignored the Range header. ContentLength is -1 if it's unknown.
+		info.size = max(resp.ContentLength, unknownFileSize)
+	default:
+		err = ErrNonZeroStatusCode
+	}
+	return
+}
+
+func newRemoteFileInfo(resp *http.Response) remoteFileInfo {
+	return remoteFileInfo{
+		name:         resolveFileName(resp),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+}
+
+// Returns the complete length of a resource from Content-Range header value
+// (e.g. "bytes 0-0/1234") or `unknownFileSize` if it's not known.
+func parseContentRangeSize(contentRange string) int64 {
+	_, complete, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return unknownFileSize
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(complete), 10, 64)
+	if err != nil || size < 0 {
+		return unknownFileSize
+	}
+	return size
+}
+
+// Downloads the file into `dir` and returns its path and the number of bytes written. Files with
+// unknown size (`fsize` is `unknownFileSize`) are checked against `maxFileSize` while downloading.
+// A paused download continues from the end of its partial file, if the source
+// supports ranges and HTTP files didn't change. Otherwise the file is downloaded again.
+func (app *App) downloadAndSaveFile(ctx context.Context, dir string, src Opener, fsize int64, job dlJob) (string, int64, error) {
+	progress := job.progress
+	var offset int64
+	if progress.filePath != "" {
+		if stat, err := os.Stat(progress.filePath); err == nil {
+			offset = stat.Size()
+		}
+	}
+
+	var (
+		body  io.ReadCloser
+		fname string
+		err   error
+	)
+	if hs, ok := src.(*httpSource); ok {
+		body, fname, offset, progress.validator, err = hs.openFrom(ctx, offset, progress.validator)
+	} else {
+		body, fname, err = src.Open(ctx, offset)
+		if offset > 0 && errors.Is(err, ErrNonZeroStatusCode) {
+			offset = 0
+			body, fname, err = src.Open(ctx, 0)
+		}
+	}
 	if err != nil {
-		return err
+		return "", 0, err
 	}
-	n, err := utils.CopyWithContext(ctx, f, resp.Body)
+	defer body.Close()
+
+	fpath := progress.filePath
+	if offset == 0 {
+		fname = job.fileNameOr(fname)
+		if fname == "" {
+			return "", 0, ErrEmptyFileName
+		}
+		fpath = filepath.Join(dir, fname)
+		progress.filePath = fpath
+	}
+	app.Log.Println("File download path:", fpath)
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(fpath, flags, 0o600)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
-	if n != fsize {
-		return ErrIncompleteDownload
+	defer f.Close()
+	n, err := utils.CopyWithContext(ctx, f, app.rateLimited(ctx, false, io.LimitReader(body, maxFileSize-offset+1)))
+	n += offset
+	if err != nil {
+		return "", n, err
 	}
-	return nil
+	if n > maxFileSize {
+		return "", n, ErrMaxFileSize
+	}
+	if fsize != unknownFileSize && n != fsize {
+		return "", n, ErrIncompleteDownload
+	}
+	return fpath, n, nil
 }
 
 func (app *App) InitBot(ctx context.Context) error {
@@ -377,11 +827,36 @@ func (app *App) InitBot(ctx context.Context) error {
 	return nil
 }
 
+func (app *App) AdminAuthMiddleware(next telbot.UpdateHandler) telbot.UpdateHandler {
+	return func(update telbot.Update) error {
+		if u, err := app.DB.UserAuthenticate(update.Message.From.Id); err == nil && u.IsAdmin {
+			return next(update)
+		}
+		return nil
+	}
+}
+
 func (app *App) ConvAuthMiddleware(next conv.ConversationHandler) conv.ConversationHandler {
 	return func(c *conv.Conversation, update telbot.Update) error {
 		if _, err := app.DB.UserAuthenticate(update.Message.From.Id); err == nil {
 			return next(c, update)
 		}
+		// the conversation is already stored, so end it on the next message
+		c.Next = endConversationHandler
+		return nil
+	}
+}
+
+func (app *App) ConvAdminAuthMiddleware(next conv.ConversationHandler) conv.ConversationHandler {
+	return func(c *conv.Conversation, update telbot.Update) error {
+		if u, err := app.DB.UserAuthenticate(update.Message.From.Id); err == nil && u.IsAdmin {
+			return next(c, update)
+		}
+		c.Next = endConversationHandler
 		return nil
 	}
 }
+
+func endConversationHandler(*conv.Conversation, telbot.Update) error {
+	return &conv.EndConversation{}
+}
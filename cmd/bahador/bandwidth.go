@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/thehxdev/telbot"
+)
+
+const (
+	downloadRateEnvVar      string = "BAHADOR_DOWNLOAD_RATE"
+	uploadRateEnvVar        string = "BAHADOR_UPLOAD_RATE"
+	userDownloadRateEnvVar  string = "BAHADOR_USER_DOWNLOAD_RATE"
+	userUploadRateEnvVar    string = "BAHADOR_USER_UPLOAD_RATE"
+	bandwidthScheduleEnvVar string = "BAHADOR_BANDWIDTH_SCHEDULE"
+
+	// how often the scheduled rates are applied
+	bandwidthScheduleInterval = time.Minute
+	// readers wait for the bytes they read in chunks of this size
+	rateChunkSize int = 32 * 1024
+	// buckets of users that have no readers and didn't transfer anything for
+	// this long are removed
+	userBucketIdleTimeout = 10 * time.Minute
+)
+
+// Kinds of rate limits. Global limits are shared by all jobs, and users have
+// their own buckets of the per user limits.
+var bandwidthKinds = []struct {
+	name   string
+	envVar string
+}{
+	{"download", downloadRateEnvVar},
+	{"upload", uploadRateEnvVar},
+	{"user_download", userDownloadRateEnvVar},
+	{"user_upload", userUploadRateEnvVar},
+}
+
+// A token bucket that lets `rate` bytes per second through, with bursts of one
+// second. Readers take the tokens of what they read and sleep while the bucket
+// is in debt, so concurrent readers share the rate.
+type tokenBucket struct {
+	mu sync.Mutex
+	// bytes per second, zero is unlimited
+	rate   int64
+	tokens float64
+	last   time.Time
+	// time of the last read, even if the rate is unlimited
+	used time.Time
+	// readers of a user's bucket, counted with bandwidthLimits.mu held
+	refs int
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: now, used: now}
+}
+
+// Idle buckets are full, so removing them doesn't change the rate of their users.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.used) > userBucketIdleTimeout
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	b.rate = rate
+	b.tokens = min(b.tokens, float64(rate))
+	b.mu.Unlock()
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	b.used = time.Now()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.tokens = min(float64(b.rate), b.tokens+now.Sub(b.last).Seconds()*float64(b.rate))
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type rateReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*tokenBucket
+	// releases the buckets when reading ends or the context is done
+	release     func()
+	releaseOnce sync.Once
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if len(p) > rateChunkSize {
+		p = p[:rateChunkSize]
+	}
+	n, err := r.r.Read(p)
+	for _, b := range r.buckets {
+		if werr := b.wait(r.ctx, n); werr != nil {
+			r.done()
+			return n, werr
+		}
+	}
+	if err != nil {
+		r.done()
+	}
+	return n, err
+}
+
+func (r *rateReader) done() {
+	r.releaseOnce.Do(r.release)
+}
+
+// Rates of a time of day window. `from` and `to` are minutes of the day, and
+// windows that end before they start continue after midnight.
+type bandwidthRule struct {
+	from, to int
+	rates    map[string]int64
+}
+
+func (r bandwidthRule) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if r.from <= r.to {
+		return m >= r.from && m < r.to
+	}
+	return m >= r.from || m < r.to
+}
+
+type bandwidthLimits struct {
+	mu sync.Mutex
+	// rates outside of the schedule, by kind
+	base     map[string]int64
+	schedule []bandwidthRule
+	// rates that are applied to the buckets
+	current      map[string]int64
+	download     *tokenBucket
+	upload       *tokenBucket
+	userDownload map[int]*tokenBucket
+	userUpload   map[int]*tokenBucket
+}
+
+func loadBandwidthLimits() (*bandwidthLimits, error) {
+	l := &bandwidthLimits{
+		base:         map[string]int64{},
+		download:     newTokenBucket(0),
+		upload:       newTokenBucket(0),
+		userDownload: map[int]*tokenBucket{},
+		userUpload:   map[int]*tokenBucket{},
+	}
+	for _, kind := range bandwidthKinds {
+		v := os.Getenv(kind.envVar)
+		if v == "" {
+			continue
+		}
+		rate, ok := parseRate(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: must be a size per second (e.g. 10m) or 0", kind.envVar)
+		}
+		l.base[kind.name] = rate
+	}
+	schedule, err := parseBandwidthSchedule(os.Getenv(bandwidthScheduleEnvVar))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", bandwidthScheduleEnvVar, err)
+	}
+	l.schedule = schedule
+	l.apply(time.Now())
+	return l, nil
+}
+
+// Parses rates in bytes per second with the units of `parseByteSize`. Zero
+// means unlimited.
+func parseRate(s string) (int64, bool) {
+	if strings.TrimSpace(s) == "0" {
+		return 0, true
+	}
+	return parseByteSize(s)
+}
+
+// Parses rules like "09:00-18:00 download=5m upload=1m; 00:00-06:00 download=0",
+// separated by semicolons. Later rules take precedence over earlier ones.
+func parseBandwidthSchedule(s string) ([]bandwidthRule, error) {
+	rules := []bandwidthRule{}
+	for field := range strings.SplitSeq(s, ";") {
+		args := strings.Fields(field)
+		if len(args) == 0 {
+			continue
+		}
+		from, to, ok := strings.Cut(args[0], "-")
+		fromTime, err1 := time.Parse("15:04", from)
+		toTime, err2 := time.Parse("15:04", to)
+		if !ok || err1 != nil || err2 != nil || len(args) < 2 {
+			return nil, fmt.Errorf("rule %q must be like \"09:00-18:00 download=5m\"", strings.TrimSpace(field))
+		}
+		rule := bandwidthRule{
+			from:  fromTime.Hour()*60 + fromTime.Minute(),
+			to:    toTime.Hour()*60 + toTime.Minute(),
+			rates: map[string]int64{},
+		}
+		for _, arg := range args[1:] {
+			kind, v, _ := strings.Cut(arg, "=")
+			rate, ok := parseRate(v)
+			if !ok || !isBandwidthKind(kind) {
+				return nil, fmt.Errorf("invalid rate %q", arg)
+			}
+			rule.rates[kind] = rate
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func isBandwidthKind(name string) bool {
+	for _, kind := range bandwidthKinds {
+		if kind.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the rates of the buckets to the ones of time `t`, and removes the buckets
+// of users that are idle.
+func (l *bandwidthLimits) apply(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rates := map[string]int64{}
+	for kind, rate := range l.base {
+		rates[kind] = rate
+	}
+	for _, rule := range l.schedule {
+		if rule.contains(t) {
+			for kind, rate := range rule.rates {
+				rates[kind] = rate
+			}
+		}
+	}
+	l.current = rates
+	l.download.setRate(rates["download"])
+	l.upload.setRate(rates["upload"])
+	for _, users := range []map[int]*tokenBucket{l.userDownload, l.userUpload} {
+		for userId, b := range users {
+			if b.refs == 0 && b.idle(t) {
+				delete(users, userId)
+			}
+		}
+	}
+	for _, b := range l.userDownload {
+		b.setRate(rates["user_download"])
+	}
+	for _, b := range l.userUpload {
+		b.setRate(rates["user_upload"])
+	}
+}
+
+// Returns the rate of programs that transfer by themselves (aria2c and yt-dlp),
+// which is the smallest of the global and per user rates when they start. They
+// can't share the buckets, so other jobs don't slow them down. Zero is unlimited.
+func (l *bandwidthLimits) processRate(upload bool) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	global, user := l.current["download"], l.current["user_download"]
+	if upload {
+		global, user = l.current["upload"], l.current["user_upload"]
+	}
+	if global <= 0 || (user > 0 && user < global) {
+		return user
+	}
+	return global
+}
+
+func (l *bandwidthLimits) setBase(kind string, rate int64) {
+	l.mu.Lock()
+	l.base[kind] = rate
+	l.mu.Unlock()
+	l.apply(time.Now())
+}
+
+// Returns the buckets that data of the job's user goes through, and a function
+// that must be called when they are not used anymore, so the user's bucket can
+// be removed.
+func (l *bandwidthLimits) buckets(upload bool, userId int, hasUser bool) ([]*tokenBucket, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	global, users, kind := l.download, l.userDownload, "user_download"
+	if upload {
+		global, users, kind = l.upload, l.userUpload, "user_upload"
+	}
+	if !hasUser {
+		return []*tokenBucket{global}, func() {}
+	}
+	b, ok := users[userId]
+	if !ok {
+		b = newTokenBucket(l.current[kind])
+		users[userId] = b
+	}
+	b.refs++
+	return []*tokenBucket{b, global}, func() {
+		l.mu.Lock()
+		b.refs--
+		l.mu.Unlock()
+	}
+}
+
+type jobUserKey struct{}
+
+// Returns a context that makes transfers of the job count towards the user's
+// rate limits.
+func withJobUser(ctx context.Context, userId int) context.Context {
+	return context.WithValue(ctx, jobUserKey{}, userId)
+}
+
+// Wraps `r` to read at the download or upload rate of the job's user.
+func (app *App) rateLimited(ctx context.Context, upload bool, r io.Reader) io.Reader {
+	userId, hasUser := ctx.Value(jobUserKey{}).(int)
+	buckets, release := app.bandwidth.buckets(upload, userId, hasUser)
+	rr := &rateReader{ctx: ctx, r: r, buckets: buckets, release: release}
+	// jobs' contexts are done when they end, even if their readers are not read to the end
+	context.AfterFunc(ctx, rr.done)
+	return rr
+}
+
+// Applies the scheduled rates when their time comes.
+func (app *App) bandwidthScheduler(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			app.bandwidth.apply(t)
+		}
+	}
+}
+
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return humanize.IBytes(uint64(rate)) + "/s"
+}
+
+// Usage: /bandwidth [<download|upload|user_download|user_upload> <rate>]
+// Changes are not saved, and scheduled rates still take precedence over them.
+func (app *App) BandwidthHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	switch len(args) {
+	case 1:
+		l := app.bandwidth
+		l.mu.Lock()
+		lines := []string{}
+		for _, kind := range bandwidthKinds {
+			line := fmt.Sprintf("%s: %s", kind.name, formatRate(l.current[kind.name]))
+			if l.current[kind.name] != l.base[kind.name] {
+				line += fmt.Sprintf(" (scheduled, otherwise %s)", formatRate(l.base[kind.name]))
+			}
+			lines = append(lines, line)
+		}
+		l.mu.Unlock()
+		params.Text = strings.Join(lines, "\n")
+	case 3:
+		rate, ok := parseRate(args[2])
+		if !ok || !isBandwidthKind(args[1]) {
+			params.Text = "Usage: /bandwidth [<download|upload|user_download|user_upload> <rate>]"
+			break
+		}
+		app.bandwidth.setBase(args[1], rate)
+		params.Text = fmt.Sprintf("Rate of %s is set to %s.", args[1], formatRate(rate))
+	default:
+		params.Text = "Usage: /bandwidth [<download|upload|user_download|user_upload> <rate>]"
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
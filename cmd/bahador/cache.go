@@ -0,0 +1,335 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cacheSizeEnvVar string = "BAHADOR_CACHE_SIZE"
+	// directory of the cache in the work directory
+	cacheDirName string = "cache"
+	// name of the downloaded file in a cache entry
+	cachedFileName string = "file"
+)
+
+// Cache of downloaded files and their archive parts. Entries are directories
+// named by the key of the file, and the least recently used ones are removed
+// when the cache is bigger than its limit. Files are hard linked between the
+// cache and jobs, so they share disk space.
+type fileCache struct {
+	mu    sync.Mutex
+	dir   string
+	limit int64
+	size  int64
+	// the cache counts against the disk budget, and shrinks when jobs need the space
+	disk *diskBudget
+	// most recently used entries are at the front
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// Returns nil if BAHADOR_CACHE_SIZE is not set, which disables the cache.
+// Entries of previous runs are kept, and their modification time is used as
+// their last use.
+func loadFileCache(disk *diskBudget) (*fileCache, error) {
+	v := os.Getenv(cacheSizeEnvVar)
+	if v == "" {
+		return nil, nil
+	}
+	limit, ok := parseByteSize(v)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s: must be a size (e.g. 20g)", cacheSizeEnvVar)
+	}
+	c := &fileCache{
+		dir:     filepath.Join(workDir, cacheDirName),
+		limit:   limit,
+		disk:    disk,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		entry   cacheEntry
+		modTime int64
+	}
+	entries := []found{}
+	for _, d := range dirs {
+		info, err := d.Info()
+		if err != nil || !d.IsDir() {
+			continue
+		}
+		entry := cacheEntry{key: d.Name(), size: dirSize(filepath.Join(c.dir, d.Name()))}
+		entries = append(entries, found{entry, info.ModTime().UnixNano()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime > entries[j].modTime })
+	for _, f := range entries {
+		c.entries[f.entry.key] = c.lru.PushBack(&f.entry)
+		c.size += f.entry.size
+	}
+	c.mu.Lock()
+	c.evict("")
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Files are identified by their URL and validators. Files without ETag and
+// Last-Modified can't be validated and are not cached. The validators are
+// asked from the server with headers of the job, so users only get the files
+// that the server gives them.
+func cacheKey(fileUrl string, info remoteFileInfo) string {
+	if info.etag == "" && info.lastModified == "" {
+		return ""
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%s\n%s\n%d", fileUrl, info.etag, info.lastModified, info.size))
+	return hex.EncodeToString(sum[:])
+}
+
+// Parts are cached for each file name and part size, because both change the
+// archive.
+func cachePartsDir(fileName, partSizeArg string) string {
+	sum := sha256.Sum256([]byte(fileName + "\x00" + partSizeArg))
+	return "parts_" + hex.EncodeToString(sum[:8])
+}
+
+// Links the cached file to `dst`.
+func (c *fileCache) getFile(key, dst string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		return 0, false
+	}
+	src := filepath.Join(c.dir, key, cachedFileName)
+	stat, err := os.Stat(src)
+	if err != nil || linkOrCopy(src, dst) != nil {
+		return 0, false
+	}
+	c.touch(key)
+	return stat.Size(), true
+}
+
+func (c *fileCache) putFile(key, src string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return nil
+	}
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if stat.Size() > c.limit {
+		return nil
+	}
+	entryDir := filepath.Join(c.dir, key)
+	if err := os.MkdirAll(entryDir, 0o700); err != nil {
+		return err
+	}
+	if err := linkOrCopy(src, filepath.Join(entryDir, cachedFileName)); err != nil {
+		os.RemoveAll(entryDir)
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: stat.Size()})
+	c.size += stat.Size()
+	c.evict(key)
+	return nil
+}
+
+// Links the cached parts to `dstDir` and returns their paths.
+func (c *fileCache) getParts(key, partsDir, dstDir string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		return nil, false
+	}
+	cached, err := filepath.Glob(filepath.Join(c.dir, key, partsDir, "*"))
+	if err != nil || len(cached) == 0 {
+		return nil, false
+	}
+	sort.Strings(cached)
+	parts := []string{}
+	for _, src := range cached {
+		dst := filepath.Join(dstDir, filepath.Base(src))
+		if err := linkOrCopy(src, dst); err != nil {
+			return nil, false
+		}
+		parts = append(parts, dst)
+	}
+	c.touch(key)
+	return parts, true
+}
+
+// Adds parts to the entry of their file. They are not cached if the file is not.
+func (c *fileCache) putParts(key, partsDir string, parts []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	dir := filepath.Join(c.dir, key, partsDir)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	var size int64
+	for _, p := range parts {
+		if err := linkOrCopy(p, filepath.Join(dir, filepath.Base(p))); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		if stat, err := os.Stat(p); err == nil {
+			size += stat.Size()
+		}
+	}
+	elem.Value.(*cacheEntry).size += size
+	c.size += size
+	c.touch(key)
+	c.evict(key)
+	return nil
+}
+
+// must be called with c.mu held
+func (c *fileCache) touch(key string) {
+	c.lru.MoveToFront(c.entries[key])
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, key), now, now)
+}
+
+// Removes the least recently used entries until the cache fits in its limit and
+// in the disk budget that jobs didn't reserve. The entry of `keep` is only
+// removed if it's the last one. Must be called with c.mu held.
+func (c *fileCache) evict(keep string) {
+	for (c.size > c.limit || c.disk.overBudget(c.size)) && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		entry := elem.Value.(*cacheEntry)
+		if entry.key == keep && c.lru.Len() > 1 {
+			elem = elem.Prev()
+			entry = elem.Value.(*cacheEntry)
+		}
+		c.removeEntry(elem)
+	}
+	c.disk.setCached(c.size)
+}
+
+// Makes room for the jobs that reserved disk space.
+func (c *fileCache) shrink() {
+	c.mu.Lock()
+	c.evict("")
+	c.mu.Unlock()
+}
+
+// Removes the entry of `key`, if it's cached.
+func (c *fileCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeEntry(elem)
+	}
+}
+
+// must be called with c.mu held
+func (c *fileCache) removeEntry(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	os.RemoveAll(filepath.Join(c.dir, entry.key))
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	c.disk.setCached(c.size)
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// Hard links `src` to `dst`, or copies it if they are on different file systems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Returns the cache key of the job's file, or an empty string if it can't be
+// cached. Only files of HTTP sources are cached, and their key is made from the
+// info that the source got before the job ran.
+func (app *App) jobCacheKey(job dlJob) string {
+	src, ok := job.source.(*httpSource)
+	if app.cache == nil || !ok {
+		return ""
+	}
+	return cacheKey(job.url, src.fileInfo())
+}
+
+// Looks up the downloaded file of the job in the cache.
+func (app *App) loadCachedFile(tmpDir string, job dlJob) bool {
+	progress := job.progress
+	src, ok := job.source.(*httpSource)
+	if !ok {
+		return false
+	}
+	fname := job.fileNameOr(src.fileInfo().name)
+	if progress.cacheKey = app.jobCacheKey(job); progress.cacheKey == "" || fname == "" {
+		return false
+	}
+
+	fpath := filepath.Join(tmpDir, fname)
+	size, ok := app.cache.getFile(progress.cacheKey, fpath)
+	if !ok {
+		return false
+	}
+	progress.filePath, progress.fileSize, progress.downloaded = fpath, size, true
+	if app.uploadedWhole(job, size) || job.archive.password != "" {
+		return true
+	}
+	partsDir := cachePartsDir(fname, job.archive.partSizeArg())
+	if parts, ok := app.cache.getParts(progress.cacheKey, partsDir, tmpDir); ok {
+		progress.parts[fpath+".7z"] = parts
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a cache of `limit` bytes in a new work directory.
+func newTestFileCache(t *testing.T, limit string, disk *diskBudget) *fileCache {
+	t.Helper()
+	oldWorkDir := workDir
+	workDir = t.TempDir()
+	t.Cleanup(func() { workDir = oldWorkDir })
+	t.Setenv(cacheSizeEnvVar, limit)
+	c, err := loadFileCache(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Writes a file of `size` bytes of `b` and returns its path.
+func writeTestFile(t *testing.T, dir, name string, b byte, size int) string {
+	t.Helper()
+	fpath := filepath.Join(dir, name)
+	if err := os.WriteFile(fpath, []byte(strings.Repeat(string(b), size)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fpath
+}
+
+func cachedKeys(c *fileCache) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := []string{}
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*cacheEntry).key)
+	}
+	return keys
+}
+
+func TestFileCachePutGet(t *testing.T) {
+	c := newTestFileCache(t, "100", &diskBudget{})
+	src := writeTestFile(t, t.TempDir(), "file.bin", 'a', 10)
+	if err := c.putFile("key", src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "copy.bin")
+	size, ok := c.getFile("key", dst)
+	if !ok || size != 10 {
+		t.Fatalf("getFile() = %d, %v, want 10, true", size, ok)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != strings.Repeat("a", 10) {
+		t.Errorf("cached file = %q", data)
+	}
+	if _, ok := c.getFile("other", filepath.Join(t.TempDir(), "x")); ok {
+		t.Error("getFile() of a missing key succeeded")
+	}
+
+	// entries of previous runs are loaded
+	c2, err := loadFileCache(&diskBudget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.size != 10 || len(c2.entries) != 1 {
+		t.Errorf("loaded cache has %d entries of %d bytes, want 1 of 10", len(c2.entries), c2.size)
+	}
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTestFileCache(t, "30", &diskBudget{})
+	dir := t.TempDir()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.putFile(key, writeTestFile(t, dir, key, key[0], 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is used again, so b is the least recently used
+	if _, ok := c.getFile("a", filepath.Join(dir, "a.copy")); !ok {
+		t.Fatal("a is not cached")
+	}
+	if err := c.putFile("d", writeTestFile(t, dir, "d", 'd', 10)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cachedKeys(c), ","); got != "d,a,c" {
+		t.Errorf("cached keys = %s, want d,a,c", got)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "b")); !os.IsNotExist(err) {
+		t.Error("directory of the evicted entry is not removed")
+	}
+
+	// files bigger than the cache are not cached
+	if err := c.putFile("big", writeTestFile(t, dir, "big", 'x', 31)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries["big"]; ok {
+		t.Error("file bigger than the cache is cached")
+	}
+}
+
+func TestFileCacheParts(t *testing.T) {
+	c := newTestFileCache(t, "100", &diskBudget{})
+	dir := t.TempDir()
+	if err := c.putFile("a", writeTestFile(t, dir, "a", 'a', 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.putFile("b", writeTestFile(t, dir, "b", 'b', 10)); err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{
+		writeTestFile(t, dir, "a.7z.002", '2', 5),
+		writeTestFile(t, dir, "a.7z.001", '1', 5),
+	}
+	partsDir := cachePartsDir("a", "5b")
+	if err := c.putParts("a", partsDir, parts); err != nil {
+		t.Fatal(err)
+	}
+	// parts count towards the entry, which is used again
+	if c.size != 30 || strings.Join(cachedKeys(c), ",") != "a,b" {
+		t.Errorf("cache is %d bytes with keys %v, want 30 with a,b", c.size, cachedKeys(c))
+	}
+
+	dstDir := t.TempDir()
+	got, ok := c.getParts("a", partsDir, dstDir)
+	if !ok || len(got) != 2 || filepath.Base(got[0]) != "a.7z.001" || filepath.Base(got[1]) != "a.7z.002" {
+		t.Fatalf("getParts() = %v, %v, want the sorted parts", got, ok)
+	}
+	if data, _ := os.ReadFile(got[1]); string(data) != "22222" {
+		t.Errorf("part = %q", data)
+	}
+	// parts of another name or part size are separate
+	if _, ok := c.getParts("a", cachePartsDir("a", "10b"), dstDir); ok {
+		t.Error("getParts() of another part size succeeded")
+	}
+	// parts of files that are not cached are not kept
+	if err := c.putParts("missing", partsDir, parts); err != nil || c.size != 30 {
+		t.Errorf("putParts() of a missing key = %v, cache size %d", err, c.size)
+	}
+
+	// an entry that grows bigger than the cache is removed, after the others
+	big := []string{writeTestFile(t, dir, "b.7z.001", 'x', 95)}
+	if err := c.putParts("b", cachePartsDir("b", "95b"), big); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 0 || c.size != 0 {
+		t.Errorf("cache has keys %v of %d bytes, want none", cachedKeys(c), c.size)
+	}
+}
+
+func TestFileCacheShrinksForDiskBudget(t *testing.T) {
+	disk := &diskBudget{limit: 100}
+	c := newTestFileCache(t, "1000", disk)
+	dir := t.TempDir()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.putFile(key, writeTestFile(t, dir, key, key[0], 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, cached, _ := disk.stat(); cached != 30 {
+		t.Errorf("cached bytes of the budget = %d, want 30", cached)
+	}
+
+	// a job reserves space that the cache uses
+	disk.reserve(80)
+	c.shrink()
+	if got := strings.Join(cachedKeys(c), ","); got != "c,b" {
+		t.Errorf("cached keys = %s, want c,b", got)
+	}
+	if _, cached, _ := disk.stat(); cached != 20 {
+		t.Errorf("cached bytes of the budget = %d, want 20", cached)
+	}
+
+	// new files don't fit in the budget either, so older entries are removed
+	if err := c.putFile("d", writeTestFile(t, dir, "d", 'd', 10)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cachedKeys(c), ","); got != "d,c" {
+		t.Errorf("cached keys = %s, want d,c", got)
+	}
+}
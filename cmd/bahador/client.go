@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const proxyEnvVar string = "BAHADOR_PROXY"
+
+type jobProxyKey struct{}
+
+// Returns a context that makes requests sent with it go through the proxy.
+func withJobProxy(ctx context.Context, proxy *url.URL) context.Context {
+	if proxy == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, jobProxyKey{}, proxy)
+}
+
+func (app *App) newHTTPClient() (*http.Client, error) {
+	if v := os.Getenv(proxyEnvVar); v != "" {
+		proxy, err := parseProxyUrl(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", proxyEnvVar, err)
+		}
+		app.globalProxy = proxy
+	}
+	prefixes, err := loadBlockedPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	app.blockedPrefixes = prefixes
+	if err := app.reloadProxyRules(); err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = app.proxyForRequest
+	transport.DialContext = app.dialContext
+	return &http.Client{Transport: &guardTransport{app: app, next: transport}}, nil
+}
+
+// Proxies are selected in this order: the proxy chosen for the job, the proxy of
+// a rule that matches the request's host, the global proxy and at last the proxy
+// from environment variables (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+func (app *App) proxyForRequest(req *http.Request) (*url.URL, error) {
+	if proxy, ok := req.Context().Value(jobProxyKey{}).(*url.URL); ok {
+		return proxy, nil
+	}
+	if proxy := app.proxyRules.forHost(req.URL.Hostname()); proxy != nil {
+		return proxy, nil
+	}
+	if app.globalProxy != nil {
+		return app.globalProxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+func parseProxyUrl(rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy url has no host")
+	}
+	return u, nil
+}
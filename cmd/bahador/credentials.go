@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/telbot"
+)
+
+// Returns headers of all credential profiles stored for the host of `link`.
+func (app *App) credentialHeaders(link string) (http.Header, error) {
+	header := http.Header{}
+	u, err := url.Parse(link)
+	if err != nil {
+		// invalid links are rejected with their source
+		return header, nil
+	}
+	creds, err := app.DB.CredentialsByHost(strings.ToLower(u.Hostname()))
+	if err != nil || len(creds) == 0 {
+		return header, err
+	}
+	if len(app.secretKey) == 0 {
+		return header, errors.New("credential profiles found but " + secretEnvVar + " is not set")
+	}
+	for _, cred := range creds {
+		plain, err := utils.Decrypt(app.secretKey, cred.Headers)
+		if err != nil {
+			return header, fmt.Errorf("failed to decrypt credential profile %s: %v", cred.Name, err)
+		}
+		h, err := parseHeaderLines(strings.Split(string(plain), "\n"))
+		if err != nil {
+			return header, err
+		}
+		for name, values := range h {
+			header[name] = values
+		}
+	}
+	return header, nil
+}
+
+// Usage: /credadd <name> <host>
+// followed by HTTP header lines in the same message.
+func (app *App) CredentialAddHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+
+	firstLine, rest, _ := strings.Cut(update.Message.Text, "\n")
+	args := strings.Fields(firstLine)
+	header, err := parseHeaderLines(strings.Split(rest, "\n"))
+	switch {
+	case err != nil:
+		params.Text = err.Error()
+	case len(args) != 3 || len(header) == 0:
+		params.Text = "Usage: /credadd <name> <host>\nfollowed by HTTP headers, one \"Name: value\" per line."
+	case len(app.secretKey) == 0:
+		params.Text = secretEnvVar + " is not set. Can't store credentials."
+	}
+	if params.Text != "" {
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := header.Write(buf); err != nil {
+		return err
+	}
+	encrypted, err := utils.Encrypt(app.secretKey, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	cred := db.Credential{
+		Name:    args[1],
+		Host:    strings.ToLower(args[2]),
+		Headers: encrypted,
+		UserId:  update.UserId(),
+	}
+	if err := app.DB.CredentialInsert(cred); err != nil {
+		return err
+	}
+
+	// don't keep secrets in chat history
+	if err := app.Bot.DeleteMessage(context.Background(), update.ChatId(), update.MessageId()); err != nil {
+		app.Log.Println(err)
+	}
+
+	params.Text = fmt.Sprintf("Credential profile %s saved for %s.", cred.Name, cred.Host)
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+func (app *App) CredentialListHandler(update telbot.Update) error {
+	creds, err := app.DB.CredentialList()
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, cred := range creds {
+		lines = append(lines, fmt.Sprintf("%s: %s", cred.Name, cred.Host))
+	}
+	text := "No credential profiles."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /creddel <name>
+func (app *App) CredentialDeleteHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 2 {
+		params.Text = "Usage: /creddel <name>"
+	} else if ok, err := app.DB.CredentialDelete(args[1]); err != nil {
+		return err
+	} else if ok {
+		params.Text = fmt.Sprintf("Credential profile %s deleted.", args[1])
+	} else {
+		params.Text = "Credential profile does not exist."
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/thehxdev/bahador/db"
+)
+
+const (
+	workDirEnvVar    string = "BAHADOR_WORK_DIR"
+	diskBudgetEnvVar string = "BAHADOR_DISK_BUDGET"
+	// temporary directories of jobs and sources
+	workDirPattern string = "bahador_*"
+	// space reserved for files that the server does not report their size
+	unknownSizeReservation int64 = 1024 * 1024 * 1024
+)
+
+// Directory of temporary files. It's set from BAHADOR_WORK_DIR on start.
+var workDir string = os.TempDir()
+
+// Disk space that jobs reserve before they download. A job is admitted if its
+// reservation fits in the budget and in the free space of the work directory.
+// The first job is always admitted, so jobs bigger than the budget run alone.
+type diskBudget struct {
+	mu sync.Mutex
+	// zero means only free space is checked
+	limit    int64
+	reserved int64
+	// size of the file cache, which is shrunk when jobs need the space
+	cached int64
+	// called when space is released
+	onRelease func()
+}
+
+func (d *diskBudget) fits(size int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.reserved == 0 || size <= 0 {
+		return true
+	}
+	if d.limit > 0 && d.reserved+size > d.limit {
+		return false
+	}
+	free, err := freeDiskSpace(workDir)
+	return err != nil || size <= free+d.cached
+}
+
+func (d *diskBudget) reserve(size int64) {
+	d.mu.Lock()
+	d.reserved += size
+	d.mu.Unlock()
+}
+
+func (d *diskBudget) release(size int64) {
+	d.mu.Lock()
+	d.reserved -= size
+	d.mu.Unlock()
+	if d.onRelease != nil {
+		d.onRelease()
+	}
+}
+
+func (d *diskBudget) setCached(size int64) {
+	d.mu.Lock()
+	d.cached = size
+	d.mu.Unlock()
+}
+
+// Returns true if a cache of `size` doesn't fit in the budget with the space that
+// jobs reserved.
+func (d *diskBudget) overBudget(size int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.limit > 0 && d.reserved+size > d.limit
+}
+
+func (d *diskBudget) stat() (reserved, cached, limit int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reserved, d.cached, d.limit
+}
+
+func freeDiskSpace(dir string) (int64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// Sets the work directory and loads the disk budget from environment variables.
+func loadDiskBudget() (*diskBudget, error) {
+	if dir := os.Getenv(workDirEnvVar); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", workDirEnvVar, err)
+		}
+		workDir = dir
+	}
+	d := &diskBudget{}
+	if v := os.Getenv(diskBudgetEnvVar); v != "" {
+		limit, ok := parseByteSize(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: must be a size (e.g. 50g)", diskBudgetEnvVar)
+		}
+		d.limit = limit
+	}
+	return d, nil
+}
+
+// Returns the disk space that the job needs while it runs. Small files are piped
+// and don't need any, unless they are saved for the cache. Archives and extracted
+// files take as much space as the downloaded file.
+func (app *App) jobDiskSize(qj queuedJob) int64 {
+	job := qj.job
+	if app.pipedJob(job, qj.size) {
+		return 0
+	}
+	size := qj.size
+	if size == unknownFileSize {
+		size = unknownSizeReservation
+	}
+	total := size
+	if !app.uploadedWhole(job, size) {
+		total += size
+	}
+	if job.extract {
+		// extracted files and archives of the big ones
+		total += 2 * size
+	}
+	return total
+}
+
+// Reserves the space that the job needs in addition to what its progress has
+// reserved before. It's called by the queue, which only admits jobs that fit.
+func (app *App) reserveJobDisk(qj queuedJob) {
+	need := app.jobDiskSize(qj) - qj.job.progress.reserved
+	if need > 0 {
+		app.disk.reserve(need)
+		qj.job.progress.disk = app.disk
+		qj.job.progress.reserved += need
+		if app.cache != nil {
+			app.cache.shrink()
+		}
+	}
+}
+
+func (app *App) jobDiskFits(qj queuedJob) bool {
+	return app.disk.fits(app.jobDiskSize(qj) - qj.job.progress.reserved)
+}
+
+// Removes temporary directories of previous runs, except the ones of
+// checkpointed jobs.
+func cleanWorkDir(db *db.DB) error {
+	checkpoints, err := db.JobCheckpointList()
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, data := range checkpoints {
+		p := newJobProgress()
+		if err := json.Unmarshal([]byte(data), p); err == nil && p.tmpDir != "" {
+			keep[filepath.Clean(p.tmpDir)] = true
+		}
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(workDir, workDirPattern))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if keep[filepath.Clean(dir)] {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/telbot"
+	conv "github.com/thehxdev/telbot/ext/conversation"
+	"github.com/thehxdev/telbot/types"
+)
+
+// name of the directory (and archive) of bundles with more than one document
+const defaultBundleName string = "bundle"
+
+// Downloads documents that users sent or forwarded to the bot.
+type telegramSource struct {
+	app  *App
+	docs []types.Document
+}
+
+func (s *telegramSource) Info(ctx context.Context) (string, int64, error) {
+	var size int64
+	for _, doc := range s.docs {
+		size += int64(doc.FileSize)
+	}
+	if len(s.docs) == 1 {
+		return sanitizeFileName(s.docs[0].FileName), size, nil
+	}
+	return defaultBundleName, size, nil
+}
+
+// Documents are saved in a directory named `defaultBundleName`. The path of the
+// document is returned instead, if there is only one.
+func (s *telegramSource) Fetch(ctx context.Context, dir string) (string, error) {
+	bundleDir := filepath.Join(dir, defaultBundleName)
+	if err := os.MkdirAll(bundleDir, 0o700); err != nil {
+		return "", err
+	}
+	names := map[string]bool{}
+	var fpath string
+	for i, doc := range s.docs {
+		name := uniqueFileName(names, sanitizeFileName(doc.FileName), i+1)
+		fpath = filepath.Join(bundleDir, name)
+		if err := s.downloadDocument(ctx, doc, fpath); err != nil {
+			return "", err
+		}
+	}
+	if len(s.docs) == 1 {
+		return fpath, nil
+	}
+	return bundleDir, nil
+}
+
+// Documents without a name are named after their position and names that are already
+// taken get a numeric suffix.
+func uniqueFileName(taken map[string]bool, name string, position int) string {
+	if name == "" {
+		name = fmt.Sprintf("document_%d", position)
+	}
+	unique := name
+	ext := filepath.Ext(name)
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// Local Bot API servers return absolute paths of files on their disk, which can be
+// read directly. Other paths are downloaded from the Bot API file endpoint.
+func (s *telegramSource) downloadDocument(ctx context.Context, doc types.Document, fpath string) error {
+	file, err := s.app.Bot.GetFile(ctx, doc.FileId)
+	if err != nil {
+		return err
+	}
+
+	var body io.ReadCloser
+	if filepath.IsAbs(file.FilePath) {
+		if body, err = os.Open(file.FilePath); err != nil {
+			return err
+		}
+	} else {
+		fileUrl, err := url.JoinPath(s.app.Bot.BaseFileUrl, file.FilePath)
+		if err != nil {
+			return err
+		}
+		// Bot API server is trusted and may be on a private address, so the guarded
+		// client is not used.
+		req, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return ErrNonZeroStatusCode
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := utils.CopyWithContext(ctx, f, s.app.rateLimited(ctx, false, body))
+	if err != nil {
+		return err
+	}
+	if doc.FileSize > 0 && n != int64(doc.FileSize) {
+		return ErrIncompleteDownload
+	}
+	return nil
+}
+
+// Parses the options of a documents job, one `key=value` per line.
+func parseDocumentOptions(text string) (fileName string, archive archiveOptions, err error) {
+	for line := range strings.SplitSeq(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "-" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			err = ErrInvalidOption
+			return
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "name":
+			if fileName = sanitizeFileName(value); fileName == "" {
+				err = ErrEmptyFileName
+				return
+			}
+		case "password":
+			archive.password = value
+		case "parts":
+			if archive.partSize, err = parsePartSize(value); err != nil {
+				return
+			}
+		default:
+			err = ErrInvalidOption
+			return
+		}
+	}
+	return
+}
+
+// Usage: /files
+// then send or forward documents, "done" and the options of the job.
+func (app *App) FilesCommandHandler(c *conv.Conversation, update telbot.Update) error {
+	var (
+		mu   sync.Mutex
+		docs []types.Document
+	)
+
+	optionsHandler := func(c *conv.Conversation, update telbot.Update) error {
+		fileName, archive, err := parseDocumentOptions(update.Message.Text)
+		if archive.password != "" {
+			// don't keep passwords in chat history
+			if err := app.Bot.DeleteMessage(context.Background(), update.ChatId(), update.MessageId()); err != nil {
+				app.Log.Println(err)
+			}
+			// replies to the deleted message would fail
+			msg := *update.Message
+			msg.Id = 0
+			update.Message = &msg
+		}
+		params := telbot.TextMessageParams{
+			ChatId:           update.ChatId(),
+			ReplyToMessageId: update.MessageId(),
+		}
+		if err != nil {
+			params.Text = err.Error()
+			app.Bot.SendMessage(context.Background(), params)
+			return &conv.EndConversation{}
+		}
+
+		job := dlJob{
+			userId:     update.UserId(),
+			fileName:   fileName,
+			archive:    archive,
+			source:     &telegramSource{app: app, docs: docs},
+			resChan:    make(chan jobResult, 1),
+			cancelChan: make(chan struct{}, 1),
+		}
+		if _, size, _ := job.source.Info(context.Background()); size > maxFileSize {
+			params.Text = ErrMaxFileSize.Error()
+			app.Bot.SendMessage(context.Background(), params)
+			return &conv.EndConversation{}
+		}
+		app.runJob(update.ChatId(), update.MessageId(), job)
+		return &conv.EndConversation{}
+	}
+
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		params := telbot.TextMessageParams{ChatId: update.ChatId()}
+		mu.Lock()
+		defer mu.Unlock()
+
+		if doc := update.Message.Document; doc != nil {
+			docs = append(docs, *doc)
+			return nil
+		}
+		if !strings.EqualFold(strings.TrimSpace(update.Message.Text), "done") {
+			params.Text = "Send a document or \"done\"."
+			_, err := app.Bot.SendMessage(context.Background(), params)
+			return err
+		}
+		if len(docs) == 0 {
+			params.Text = "No documents received."
+			app.Bot.SendMessage(context.Background(), params)
+			return &conv.EndConversation{}
+		}
+
+		params.Text = fmt.Sprintf("Received %d documents. Send the options, one per line, or \"-\" for none:\n"+
+			"password=<password> to encrypt the archive\n"+
+			"parts=<size> to change the size of archive parts (e.g. 50m)\n"+
+			"name=<name> to rename the file or archive\n"+
+			"Documents are bundled into one 7z archive if there is more than one.", len(docs))
+		c.Next = optionsHandler
+		_, err := app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   "Send or forward documents to the bot. Send \"done\" when finished.",
+	})
+	return err
+}
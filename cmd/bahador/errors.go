@@ -18,15 +18,162 @@ func (e *IncompleteDownloadError) Error() string {
 	return "file download is incomplete"
 }
 
+type IncompleteUploadError struct{}
+
+func (e *IncompleteUploadError) Error() string {
+	return "file upload is incomplete"
+}
+
 type NonZeroStatusError struct{}
 
 func (e *NonZeroStatusError) Error() string {
 	return "non-zero http response status code"
 }
 
+type InvalidHeaderError struct{}
+
+func (e *InvalidHeaderError) Error() string {
+	return "invalid http header (headers must be in \"Name: value\" form)"
+}
+
+type InvalidOptionError struct{}
+
+func (e *InvalidOptionError) Error() string {
+	return "unknown job option"
+}
+
+type ProxyNotFoundError struct{}
+
+func (e *ProxyNotFoundError) Error() string {
+	return "proxy does not exist (see /proxies)"
+}
+
+type BlockedAddressError struct{}
+
+func (e *BlockedAddressError) Error() string {
+	return "destination address is not allowed"
+}
+
+type UnsupportedUrlError struct{}
+
+func (e *UnsupportedUrlError) Error() string {
+	return "unsupported link (supported links are http, https, ftp, ftps, sftp, magnet and .torrent links)"
+}
+
+type NoSSHCredentialError struct{}
+
+func (e *NoSSHCredentialError) Error() string {
+	return "no SSH credentials stored for this user and host (see /sshadd)"
+}
+
+type CredentialProfileError struct{}
+
+func (e *CredentialProfileError) Error() string {
+	return "credential profiles of this host could not be used, ask an admin to check them"
+}
+
+type TorrentProxyError struct{}
+
+func (e *TorrentProxyError) Error() string {
+	return "torrents can only be downloaded through http proxies"
+}
+
+type HostKeyMismatchError struct{}
+
+func (e *HostKeyMismatchError) Error() string {
+	return "server's host key does not match the saved host key"
+}
+
+type NotRegularFileError struct{}
+
+func (e *NotRegularFileError) Error() string {
+	return "path is not a regular file"
+}
+
+type TorrentUnavailableError struct{}
+
+func (e *TorrentUnavailableError) Error() string {
+	return "torrent downloads are not available (aria2c is not installed)"
+}
+
+type InvalidTorrentError struct{}
+
+func (e *InvalidTorrentError) Error() string {
+	return "invalid torrent metadata"
+}
+
+type InvalidSelectionError struct{}
+
+func (e *InvalidSelectionError) Error() string {
+	return "invalid selection (send numbers like 1,3,5-7 or \"all\")"
+}
+
+type InvalidPartSizeError struct{}
+
+func (e *InvalidPartSizeError) Error() string {
+	return "invalid part size (send a size between 1m and 200m like 50m)"
+}
+
+type EmptyArchiveError struct{}
+
+func (e *EmptyArchiveError) Error() string {
+	return "archive has no files"
+}
+
+type NoAnswerError struct{}
+
+func (e *NoAnswerError) Error() string {
+	return "no answer received in time"
+}
+
+type InvalidStartTimeError struct{}
+
+func (e *InvalidStartTimeError) Error() string {
+	return "invalid start time (use \"at 02:00\", \"at 2006-01-02 02:00\" or \"in 2h30m\")"
+}
+
+type UnwatchableUrlError struct{}
+
+func (e *UnwatchableUrlError) Error() string {
+	return "only http and https links to files can be watched"
+}
+
+type JobPausedError struct{}
+
+func (e *JobPausedError) Error() string {
+	return "job paused"
+}
+
+type PausedTooLongError struct{}
+
+func (e *PausedTooLongError) Error() string {
+	return "job was paused for too long, its files are removed"
+}
+
 var (
 	ErrEmptyFileName      = &EmptyFileNameError{}
 	ErrMaxFileSize        = &MaxFileSizeError{}
 	ErrIncompleteDownload = &IncompleteDownloadError{}
+	ErrIncompleteUpload   = &IncompleteUploadError{}
 	ErrNonZeroStatusCode  = &NonZeroStatusError{}
+	ErrInvalidHeader      = &InvalidHeaderError{}
+	ErrInvalidOption      = &InvalidOptionError{}
+	ErrProxyNotFound      = &ProxyNotFoundError{}
+	ErrBlockedAddress     = &BlockedAddressError{}
+	ErrUnsupportedUrl     = &UnsupportedUrlError{}
+	ErrNoSSHCredential    = &NoSSHCredentialError{}
+	ErrCredentialProfile  = &CredentialProfileError{}
+	ErrHostKeyMismatch    = &HostKeyMismatchError{}
+	ErrTorrentProxy       = &TorrentProxyError{}
+	ErrNotRegularFile     = &NotRegularFileError{}
+	ErrTorrentUnavailable = &TorrentUnavailableError{}
+	ErrInvalidTorrent     = &InvalidTorrentError{}
+	ErrInvalidSelection   = &InvalidSelectionError{}
+	ErrInvalidPartSize    = &InvalidPartSizeError{}
+	ErrEmptyArchive       = &EmptyArchiveError{}
+	ErrNoAnswer           = &NoAnswerError{}
+	ErrInvalidStartTime   = &InvalidStartTimeError{}
+	ErrUnwatchableUrl     = &UnwatchableUrlError{}
+	ErrJobPaused          = &JobPausedError{}
+	ErrPausedTooLong      = &PausedTooLongError{}
 )
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thehxdev/telbot"
+	conv "github.com/thehxdev/telbot/ext/conversation"
+)
+
+// how long a running job waits for the answer of its question
+const jobAnswerTimeout = 10 * time.Minute
+
+type extractedFile struct {
+	// path relative to the extraction directory
+	path string
+	size int64
+}
+
+// Extracts the archive and uploads the files that user selects (or all of them)
+// as separate documents. Resumed jobs continue with the entries that are not
+// uploaded yet.
+func (app *App) uploadExtracted(ctx context.Context, tmpDir, archivePath string, job dlJob) (res jobResult) {
+	logEvent := job.eventLogger
+	progress := job.progress
+
+	outDir := filepath.Join(tmpDir, "extracted")
+	if progress.extracted == nil {
+		logEvent("Extracting the archive...")
+		// a paused extraction starts over
+		os.RemoveAll(outDir)
+		var files []extractedFile
+		err := withLimit(ctx, app.limits.archivers, func() (err error) {
+			files, err = extractArchiveFiles(ctx, archivePath, outDir)
+			return
+		})
+		if err != nil {
+			res.error = err
+			return
+		}
+		if len(files) == 0 {
+			res.error = ErrEmptyArchive
+			return
+		}
+		progress.extracted = files
+	}
+	if progress.entries == nil {
+		selected, err := selectExtractedFiles(ctx, filepath.Base(archivePath), progress.extracted, job)
+		if err != nil {
+			res.error = err
+			return
+		}
+		progress.entries = selected
+	}
+	selected := progress.entries
+
+	// entries are uploaded like downloaded files, but never extracted again
+	entryJob := job
+	entryJob.extract = false
+	for i := len(progress.entryFileIds); i < len(selected); i++ {
+		f := selected[i]
+		logEvent("Uploading file %d of %d...", i+1, len(selected))
+		// each entry gets its own directory, so archive parts of entries don't mix
+		entryDir := filepath.Join(tmpDir, fmt.Sprintf("entry_%d", i))
+		entryPath := filepath.Join(entryDir, filepath.Base(f.path))
+		if _, err := os.Stat(entryPath); err != nil {
+			if err := os.MkdirAll(entryDir, 0o700); err != nil {
+				res.error = err
+				return
+			}
+			if err := os.Rename(filepath.Join(outDir, f.path), entryPath); err != nil {
+				res.error = err
+				return
+			}
+		}
+		entryRes := app.uploadLocalFile(ctx, entryDir, entryPath, f.size, entryJob)
+		if entryRes.error != nil {
+			res.error = entryRes.error
+			return
+		}
+		os.RemoveAll(entryDir)
+		progress.entryFileIds = append(progress.entryFileIds, entryRes.fileIds)
+	}
+	for _, fileIds := range progress.entryFileIds {
+		res.fileIds = append(res.fileIds, fileIds...)
+	}
+	return
+}
+
+// Returns the files that user selects, or all of them if the job can't ask.
+func selectExtractedFiles(ctx context.Context, archiveName string, files []extractedFile, job dlJob) ([]extractedFile, error) {
+	selected := files
+	if job.ask != nil && len(files) > 1 {
+		paths := make([]string, len(files))
+		sizes := make([]int64, len(files))
+		for i, f := range files {
+			paths[i], sizes[i] = f.path, f.size
+		}
+		answer, err := job.ask(ctx, fileListQuestion(archiveName, paths, sizes))
+		if err != nil {
+			return nil, err
+		}
+		indexes, err := parseSelection(answer, len(files))
+		if err != nil {
+			return nil, err
+		}
+		if indexes != nil {
+			selected = []extractedFile{}
+			for _, i := range indexes {
+				selected = append(selected, files[i-1])
+			}
+		}
+	}
+	return selected, nil
+}
+
+// Extracts the archive into `outDir` and returns its regular files. Compressed tar
+// files (e.g. .tar.gz) are extracted in two steps. The archive is removed to free
+// the disk space.
+func extractArchiveFiles(ctx context.Context, archivePath, outDir string) ([]extractedFile, error) {
+	for range 2 {
+		size, err := ArchiveContentSize(ctx, archivePath)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxFileSize {
+			return nil, ErrMaxFileSize
+		}
+		if err := ExtractArchive(ctx, archivePath, outDir); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(archivePath); err != nil {
+			return nil, err
+		}
+
+		files, err := listExtractedFiles(outDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) != 1 || !strings.EqualFold(filepath.Ext(files[0].path), ".tar") {
+			return files, nil
+		}
+		tarPath := filepath.Join(filepath.Dir(outDir), filepath.Base(files[0].path))
+		if err := os.Rename(filepath.Join(outDir, files[0].path), tarPath); err != nil {
+			return nil, err
+		}
+		archivePath = tarPath
+	}
+	return listExtractedFiles(outDir)
+}
+
+// Symbolic links and other special files are skipped.
+func listExtractedFiles(dir string) ([]extractedFile, error) {
+	files := []extractedFile{}
+	err := filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		files = append(files, extractedFile{path: filepath.ToSlash(rel), size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// Returns a function that lets the job ask its user a question while it's running.
+// The answer is the next message of the user in the conversation. Updates are
+// handled in their own goroutines, so the next step of the conversation is only
+// set here, before the job runs, and passes messages to the job through a channel.
+func (app *App) jobAsker(c *conv.Conversation, update telbot.Update) func(context.Context, string) (string, error) {
+	chatId, msgId := update.ChatId(), update.MessageId()
+	answerChan := make(chan string, 1)
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		select {
+		case answerChan <- update.Message.Text:
+		default:
+		}
+		return nil
+	}
+	return func(ctx context.Context, question string) (string, error) {
+		// messages that were sent before the question are not answers
+		select {
+		case <-answerChan:
+		default:
+		}
+		_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+			ChatId:           chatId,
+			Text:             question,
+			ReplyToMessageId: msgId,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		select {
+		case answer := <-answerChan:
+			return answer, nil
+		case <-time.After(jobAnswerTimeout):
+			return "", ErrNoAnswer
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// file names are kept short enough to leave room for archive suffixes (.7z.001)
+	maxFileNameLength int    = 200
+	defaultFileName   string = "download"
+)
+
+// Query parameters that download endpoints (e.g. download.php?file=x.zip) use for file names.
+var fileNameQueryParams = []string{"filename", "file_name", "file", "name", "fn", "f", "download"}
+
+// Common extensions for content types, since `mime.ExtensionsByType` returns
+// all known extensions in alphabetical order.
+var contentTypeExtensions = map[string]string{
+	"application/gzip":             ".gz",
+	"application/json":             ".json",
+	"application/pdf":              ".pdf",
+	"application/vnd.rar":          ".rar",
+	"application/x-7z-compressed":  ".7z",
+	"application/x-bzip2":          ".bz2",
+	"application/x-gzip":           ".gz",
+	"application/x-rar-compressed": ".rar",
+	"application/x-tar":            ".tar",
+	"application/x-xz":             ".xz",
+	"application/zip":              ".zip",
+	"audio/mpeg":                   ".mp3",
+	"image/jpeg":                   ".jpg",
+	"text/html":                    ".html",
+	"text/plain":                   ".txt",
+	"video/mp4":                    ".mp4",
+	"video/x-matroska":             ".mkv",
+}
+
+// Returns a safe file name for the response. The name is taken from Content-Disposition
+// header, query parameters or path of the final URL (after redirects), in that order.
+func resolveFileName(resp *http.Response) string {
+	fname := contentDispositionFileName(resp.Header.Get("Content-Disposition"))
+	if fname == "" && resp.Request != nil && resp.Request.URL != nil {
+		fname = urlFileName(resp.Request.URL)
+	}
+	if fname = sanitizeFileName(fname); fname == "" {
+		fname = defaultFileName
+	}
+	if path.Ext(fname) == "" {
+		fname += contentTypeExtension(resp.Header.Get("Content-Type"))
+	}
+	return fname
+}
+
+func contentDispositionFileName(cd string) string {
+	if cd == "" {
+		return ""
+	}
+	// ParseMediaType decodes RFC 2231/5987 `filename*` parameters too
+	if _, params, err := mime.ParseMediaType(cd); err == nil {
+		return params["filename"]
+	}
+
+	// Fallback for malformed headers (e.g. unquoted file names with spaces)
+	var fname string
+	for param := range strings.SplitSeq(cd, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "filename*":
+			if decoded := decodeExtValue(value); decoded != "" {
+				return decoded
+			}
+		case "filename":
+			fname = value
+		}
+	}
+	return fname
+}
+
+// Decodes RFC 5987 extended values in charset'language'percent-encoded form.
+func decodeExtValue(value string) string {
+	charset, rest, ok := strings.Cut(value, "'")
+	if !ok {
+		return ""
+	}
+	_, encoded, ok := strings.Cut(rest, "'")
+	if !ok {
+		return ""
+	}
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(charset) {
+	case "utf-8":
+		if !utf8.ValidString(decoded) {
+			return ""
+		}
+		return decoded
+	case "iso-8859-1":
+		runes := make([]rune, 0, len(decoded))
+		for i := 0; i < len(decoded); i++ {
+			runes = append(runes, rune(decoded[i]))
+		}
+		return string(runes)
+	}
+	return ""
+}
+
+func urlFileName(u *url.URL) string {
+	query := u.Query()
+	if cd := query.Get("response-content-disposition"); cd != "" {
+		if fname := contentDispositionFileName(cd); fname != "" {
+			return fname
+		}
+	}
+	for _, key := range fileNameQueryParams {
+		v := query.Get(key)
+		if v != "" && path.Ext(v) != "" {
+			return path.Base(v)
+		}
+	}
+	fname := path.Base(u.Path)
+	if fname == "." || fname == "/" {
+		return ""
+	}
+	return fname
+}
+
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := contentTypeExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// Makes the name safe to be joined to a directory path. Returns an empty
+// string if nothing usable is left.
+func sanitizeFileName(fname string) string {
+	// only keep the last path element (both unix and windows separators)
+	if i := strings.LastIndexAny(fname, `/\`); i >= 0 {
+		fname = fname[i+1:]
+	}
+	fname = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, fname)
+	// no hidden files, "." or ".."
+	fname = strings.TrimLeft(strings.TrimSpace(fname), ".")
+	if len(fname) > maxFileNameLength {
+		ext := path.Ext(fname)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		fname = strings.ToValidUTF8(fname[:maxFileNameLength-len(ext)], "") + ext
+	}
+	return fname
+}
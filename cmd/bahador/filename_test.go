@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `..\..\Windows\system.ini`, "system.ini"},
+		{"mixed separators", `a/b\c.txt`, "c.txt"},
+		{"trailing separator", "dir/", ""},
+		{"dot dot", "..", ""},
+		{"dot", ".", ""},
+		{"hidden file", ".bashrc", "bashrc"},
+		{"empty", "", ""},
+		{"spaces", "   ", ""},
+		{"surrounding spaces", "  file.zip  ", "file.zip"},
+		{"control characters", "a\x00b\nc\td\x7f.txt", "a_b_c_d_.txt"},
+		{"reserved characters", `what?<is>:this|"*.txt`, "what__is__this___.txt"},
+		{"invalid utf-8", "\xff\xfe.bin", "__.bin"},
+		{"unicode", "فایل ویدیو.mkv", "فایل ویدیو.mkv"},
+		{
+			"long name keeps its extension",
+			strings.Repeat("a", 300) + ".mp4",
+			strings.Repeat("a", maxFileNameLength-len(".mp4")) + ".mp4",
+		},
+		{
+			// 3 byte runes don't end at the limit, so the partial rune is dropped
+			"truncated at a rune boundary",
+			strings.Repeat("中", 100) + ".zip",
+			strings.Repeat("中", 65) + ".zip",
+		},
+		{
+			"long extension is not kept",
+			"a." + strings.Repeat("x", 300),
+			"a." + strings.Repeat("x", maxFileNameLength-2),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFileName(tt.in)
+			if got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(got) > maxFileNameLength || !utf8.ValidString(got) {
+				t.Errorf("sanitizeFileName(%q) = %q is too long or not valid UTF-8", tt.in, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/thehxdev/bahador/db"
+)
+
+const (
+	httpAddrEnvVar string = "BAHADOR_HTTP_ADDR"
+	// public url that the server is reached at
+	httpUrlEnvVar          string = "BAHADOR_HTTP_URL"
+	linkMaxDownloadsEnvVar string = "BAHADOR_LINK_MAX_DOWNLOADS"
+
+	// how often expired links are deleted
+	expiredLinksInterval = time.Hour
+	// time that downloads have to finish when the server is stopped
+	fileServerShutdownTimeout = 5 * time.Second
+)
+
+// Serves stored files through signed links that expire after the link TTL and
+// may only be downloaded a limited number of times. Links are signed with a key
+// derived from the bot's secret key, and are saved in database so they can be
+// counted and revoked.
+type fileServer struct {
+	app          *App
+	addr         string
+	baseUrl      *url.URL
+	key          []byte
+	ttl          time.Duration
+	maxDownloads int
+	client       *http.Client
+}
+
+// Returns nil if BAHADOR_HTTP_ADDR is not set, which disables the server.
+func (app *App) loadFileServer() (*fileServer, error) {
+	addr := os.Getenv(httpAddrEnvVar)
+	if addr == "" {
+		return nil, nil
+	}
+	if len(app.secretKey) == 0 {
+		return nil, fmt.Errorf("%s needs %s to sign links", httpAddrEnvVar, secretEnvVar)
+	}
+	baseUrl, err := parseStorageUrl(httpUrlEnvVar, os.Getenv(httpUrlEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := loadLinkTTL()
+	if err != nil {
+		return nil, err
+	}
+	maxDownloads := 0
+	if v := os.Getenv(linkMaxDownloadsEnvVar); v != "" {
+		if maxDownloads, err = strconv.Atoi(v); err != nil || maxDownloads < 0 {
+			return nil, fmt.Errorf("invalid %s: must be a number, 0 is unlimited", linkMaxDownloadsEnvVar)
+		}
+	}
+	return &fileServer{
+		app:          app,
+		addr:         addr,
+		baseUrl:      baseUrl,
+		key:          hmacSHA256(app.secretKey, "bahador file links"),
+		ttl:          ttl,
+		maxDownloads: maxDownloads,
+		client:       newStorageClient(),
+	}, nil
+}
+
+// Returns the link that users get for a stored file.
+func (app *App) fileLink(ctx context.Context, userId int, id string) (string, error) {
+	if app.files == nil {
+		return app.storage.Link(ctx, id)
+	}
+	return app.files.newLink(userId, id)
+}
+
+func (s *fileServer) newLink(userId int, id string) (string, error) {
+	exp := time.Now().Add(s.ttl).Unix()
+	linkId, err := s.app.DB.LinkInsert(db.Link{
+		UserId:       userId,
+		FileId:       id,
+		ExpiresAt:    exp,
+		MaxDownloads: s.maxDownloads,
+	})
+	if err != nil {
+		return "", err
+	}
+	u := s.baseUrl.JoinPath("f", strconv.FormatInt(linkId, 10), storageFileName(id))
+	u.RawQuery = url.Values{
+		"exp": {strconv.FormatInt(exp, 10)},
+		"sig": {s.sign(linkId, exp)},
+	}.Encode()
+	return u.String(), nil
+}
+
+func (s *fileServer) sign(linkId, exp int64) string {
+	return hex.EncodeToString(hmacSHA256(s.key, fmt.Sprintf("%d:%d", linkId, exp)))
+}
+
+// Listens on the address of the server and serves until `ctx` is done.
+func (s *fileServer) start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	// links are served at the path of the public url too
+	mux.HandleFunc("GET "+path.Join("/", s.baseUrl.Path, "f/{id}/{name}"), s.serveFile)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          s.app.Log,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.app.Log.Println(err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(expiredLinksInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), fileServerShutdownTimeout)
+				defer cancel()
+				srv.Shutdown(shutdownCtx)
+				return
+			case t := <-ticker.C:
+				if _, err := s.app.DB.LinksDeleteExpired(t.Unix()); err != nil {
+					s.app.Log.Println(err)
+				}
+			}
+		}
+	}()
+	s.app.Log.Println("serving files on", ln.Addr())
+	return nil
+}
+
+// Keeps the status of the response for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Handles GET and HEAD requests of /f/<link id>/<name>?exp=<unix time>&sig=<signature>.
+// Only responses that start from the beginning of the file count as downloads,
+// so resumed downloads and players that seek don't use up the link.
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	linkId, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	defer func() {
+		s.app.Log.Printf("link %d: %s %s range=%q from %s: %d",
+			linkId, r.Method, r.URL.Path, r.Header.Get("Range"), r.RemoteAddr, rec.status)
+	}()
+
+	exp, _ := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	sig, _ := hex.DecodeString(r.URL.Query().Get("sig"))
+	expected, _ := hex.DecodeString(s.sign(linkId, exp))
+	if !hmac.Equal(sig, expected) {
+		http.Error(rec, "invalid link", http.StatusForbidden)
+		return
+	}
+	link, err := s.app.DB.LinkGet(linkId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && link.ExpiresAt != exp) {
+		http.Error(rec, "link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.app.Log.Println(err)
+		http.Error(rec, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if time.Now().Unix() > exp {
+		http.Error(rec, "link expired", http.StatusGone)
+		return
+	}
+
+	// ranges are resolved by the storage or by ServeContent, and the response
+	// decides if it's a download
+	var out http.ResponseWriter = rec
+	if r.Method == http.MethodGet {
+		out = &downloadCounter{ResponseWriter: rec, s: s, linkId: linkId}
+	}
+	if local, ok := s.app.storage.(*localStorage); ok {
+		s.serveLocal(out, r, local, link.FileId)
+		return
+	}
+	s.proxy(out, r, link.FileId)
+}
+
+// Counts a download of the link when the response starts from the first byte of
+// the file: whole files, ranges that start at zero (including suffix ranges that
+// reach it), and multipart responses of several ranges. Responses are replaced
+// with an error when the link has no downloads left.
+type downloadCounter struct {
+	http.ResponseWriter
+	s           *fileServer
+	linkId      int64
+	wroteHeader bool
+	refused     bool
+}
+
+func (w *downloadCounter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if !responseFromStart(status, w.Header()) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ok, err := w.s.app.DB.LinkCountDownload(w.linkId)
+	if err == nil && ok {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.refused = true
+	for _, name := range []string{"Content-Disposition", "Content-Range", "Content-Encoding", "ETag", "Last-Modified"} {
+		w.Header().Del(name)
+	}
+	if err != nil {
+		w.s.app.Log.Println(err)
+		http.Error(w.ResponseWriter, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w.ResponseWriter, "download limit reached", http.StatusGone)
+}
+
+func (w *downloadCounter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.refused {
+		return 0, http.ErrBodyNotAllowed
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func responseFromStart(status int, header http.Header) bool {
+	switch status {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		// multipart responses don't have a Content-Range, and one of their ranges may start at zero
+		return contentRangeStart(header.Get("Content-Range")) <= 0
+	}
+	return false
+}
+
+// Browsers save the file with its name, instead of the last part of the url.
+func setAttachment(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": storageFileName(id)}))
+}
+
+// Files of the local storage are served from the disk.
+func (s *fileServer) serveLocal(w http.ResponseWriter, r *http.Request, storage *localStorage, id string) {
+	if !filepath.IsLocal(filepath.FromSlash(id)) {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(storage.dir, filepath.FromSlash(id)))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	setAttachment(w, id)
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
+
+// Headers of range requests that are passed between clients and storages.
+var (
+	proxyRequestHeaders  = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+	proxyResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+)
+
+// Files of other storages are streamed from their links.
+func (s *fileServer) proxy(w http.ResponseWriter, r *http.Request, id string) {
+	fileUrl, err := s.app.storage.Link(r.Context(), id)
+	if err != nil {
+		s.app.Log.Println(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, fileUrl, nil)
+	if err != nil {
+		s.app.Log.Println(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	for _, name := range proxyRequestHeaders {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.app.Log.Println(err)
+		http.Error(w, "storage is unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusNotFound:
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	default:
+		s.app.Log.Println("storage responded with", resp.Status)
+		http.Error(w, "storage is unavailable", http.StatusBadGateway)
+		return
+	}
+	for _, name := range proxyResponseHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	setAttachment(w, id)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
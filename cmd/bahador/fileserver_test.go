@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFileSize = 100
+
+// Returns a file server of a local storage that has a file "x/f.bin", which is
+// served on a test server at the base url of its links.
+func newTestFileServer(t *testing.T, maxDownloads int) *fileServer {
+	t.Helper()
+	app := newTestApp(t)
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "x"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "x", "f.bin"), []byte(strings.Repeat("a", testFileSize)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	app.storage = &localStorage{dir: dir}
+
+	s := &fileServer{app: app, key: []byte("key"), ttl: time.Hour, maxDownloads: maxDownloads}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /f/{id}/{name}", s.serveFile)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s.baseUrl, _ = url.Parse(srv.URL)
+	return s
+}
+
+// Sends a request of the link and returns the status of the response.
+func requestTestLink(t *testing.T, method, link, rangeHeader string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, link, nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func linkDownloads(t *testing.T, s *fileServer, link string) int {
+	t.Helper()
+	u, _ := url.Parse(link)
+	// links are /f/<link id>/<name>
+	linkId, _ := strconv.ParseInt(strings.Split(u.Path, "/")[2], 10, 64)
+	l, err := s.app.DB.LinkGet(linkId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Downloads
+}
+
+func TestFileServerCountsDownloads(t *testing.T) {
+	s := newTestFileServer(t, 0)
+	tests := []struct {
+		name    string
+		method  string
+		rng     string
+		status  int
+		counted bool
+	}{
+		{"whole file", http.MethodGet, "", http.StatusOK, true},
+		{"range from zero", http.MethodGet, "bytes=0-", http.StatusPartialContent, true},
+		{"suffix range of the whole file", http.MethodGet, "bytes=-100", http.StatusPartialContent, true},
+		{"suffix range longer than the file", http.MethodGet, "bytes=-500", http.StatusPartialContent, true},
+		{"multipart ranges", http.MethodGet, "bytes=0-9,50-59", http.StatusPartialContent, true},
+		{"range from the middle", http.MethodGet, "bytes=50-", http.StatusPartialContent, false},
+		{"suffix range of the end", http.MethodGet, "bytes=-10", http.StatusPartialContent, false},
+		{"head", http.MethodHead, "", http.StatusOK, false},
+		{"unsatisfiable range", http.MethodGet, "bytes=500-", http.StatusRequestedRangeNotSatisfiable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, err := s.newLink(1, "x/f.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := requestTestLink(t, tt.method, link, tt.rng); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			want := 0
+			if tt.counted {
+				want = 1
+			}
+			if n := linkDownloads(t, s, link); n != want {
+				t.Errorf("downloads = %d, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestFileServerDownloadLimit(t *testing.T) {
+	s := newTestFileServer(t, 1)
+	link, err := s.newLink(1, "x/f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := requestTestLink(t, http.MethodGet, link, ""); status != http.StatusOK {
+		t.Fatalf("first download: status = %d, want %d", status, http.StatusOK)
+	}
+	// ranges that don't start at zero and HEAD requests are still served
+	if status := requestTestLink(t, http.MethodGet, link, "bytes=50-"); status != http.StatusPartialContent {
+		t.Errorf("resumed download: status = %d, want %d", status, http.StatusPartialContent)
+	}
+	if status := requestTestLink(t, http.MethodHead, link, ""); status != http.StatusOK {
+		t.Errorf("HEAD: status = %d, want %d", status, http.StatusOK)
+	}
+	// but new downloads are refused without the file
+	for _, rng := range []string{"", "bytes=0-", "bytes=-100"} {
+		req, _ := http.NewRequest(http.MethodGet, link, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGone || resp.Header.Get("Content-Disposition") != "" || resp.Header.Get("Content-Range") != "" {
+			t.Errorf("download after the limit with range %q: status = %d, headers = %v, want %d without the file's headers",
+				rng, resp.StatusCode, resp.Header, http.StatusGone)
+		}
+	}
+	if n := linkDownloads(t, s, link); n != 1 {
+		t.Errorf("downloads = %d, want 1", n)
+	}
+}
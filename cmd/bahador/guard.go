@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/telbot"
+)
+
+const blockedCIDRsEnvVar string = "BAHADOR_BLOCKED_CIDRS"
+
+// Addresses that user-submitted URLs must not reach. More ranges can be added
+// with BAHADOR_BLOCKED_CIDRS environment variable (comma separated).
+var defaultBlockedCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+func loadBlockedPrefixes() ([]netip.Prefix, error) {
+	cidrs := defaultBlockedCIDRs
+	if v := os.Getenv(blockedCIDRsEnvVar); v != "" {
+		cidrs = append(cidrs[:len(cidrs):len(cidrs)], strings.Split(v, ",")...)
+	}
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", blockedCIDRsEnvVar, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func (app *App) addrIsBlocked(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range app.blockedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the host is allowed by admins and can reach blocked addresses.
+// Hosts that are denied by admins result in `ErrBlockedAddress`.
+func (app *App) checkHost(host string) (bool, error) {
+	rule, err := app.DB.HostRuleForHost(host)
+	if err != nil {
+		return false, err
+	}
+	if rule == nil {
+		return false, nil
+	}
+	if !rule.Allow {
+		return false, ErrBlockedAddress
+	}
+	return true, nil
+}
+
+// Returns true if connections to the host must be blocked, for programs that
+// connect by themselves and can't use the guarded dialer. Hosts that can't be
+// resolved are blocked too.
+func (app *App) hostBlocked(ctx context.Context, host string) bool {
+	allowed, err := app.checkHost(host)
+	if err != nil {
+		return true
+	}
+	if allowed {
+		return false
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		if app.addrIsBlocked(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyDialKey struct{}
+
+// Proxies are defined by admins and trusted, even on local addresses. The
+// transport marks requests with the address of their proxy, so only that dial
+// skips the guard.
+func withProxyDial(ctx context.Context, proxy *url.URL) context.Context {
+	return context.WithValue(ctx, proxyDialKey{}, proxyDialAddr(proxy))
+}
+
+// Returns the address that the transport dials for the proxy.
+func proxyDialAddr(proxy *url.URL) string {
+	if port := proxy.Port(); port != "" {
+		return net.JoinHostPort(proxy.Hostname(), port)
+	}
+	port := "1080"
+	switch proxy.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// Dials connections of the http client. Since the resolved address is checked
+// right before connecting, redirects and DNS rebinding can't bypass the guard.
+func (app *App) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if proxyAddr, _ := ctx.Value(proxyDialKey{}).(string); proxyAddr != address {
+		allowed, err := app.checkHost(host)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			dialer.Control = app.dialControl
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (app *App) dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if app.addrIsBlocked(addr) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// Checks every request (including redirects) before it's sent.
+type guardTransport struct {
+	app  *App
+	next http.RoundTripper
+}
+
+func (t *guardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, ErrBlockedAddress
+	}
+	host := req.URL.Hostname()
+	allowed, err := t.app.checkHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Proxies resolve the host themselves, so the dialer can't see the address.
+	// Resolve it here to reject hosts that point to blocked addresses.
+	proxy, err := t.app.proxyForRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		if !allowed {
+			if err := t.app.checkResolvedHost(req.Context(), host); err != nil {
+				return nil, err
+			}
+		}
+		req = req.WithContext(withProxyDial(req.Context(), proxy))
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// Returns ErrBlockedAddress if the host resolves to a blocked address.
+func (app *App) checkResolvedHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if app.addrIsBlocked(addr) {
+			return ErrBlockedAddress
+		}
+	}
+	return nil
+}
+
+func (app *App) HostRuleListHandler(update telbot.Update) error {
+	rules, err := app.DB.HostRuleList()
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, r := range rules {
+		kind := "deny"
+		if r.Allow {
+			kind = "allow"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", kind, r.Host))
+	}
+	text := "No host rules defined."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /hostallow <host>
+func (app *App) HostAllowHandler(update telbot.Update) error {
+	return app.hostRuleAdd(update, true)
+}
+
+// Usage: /hostdeny <host>
+func (app *App) HostDenyHandler(update telbot.Update) error {
+	return app.hostRuleAdd(update, false)
+}
+
+func (app *App) hostRuleAdd(update telbot.Update, allow bool) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 2 {
+		command, _ := update.Message.Command()
+		params.Text = fmt.Sprintf("Usage: /%s <host>", command)
+	} else {
+		rule := db.HostRule{Host: strings.ToLower(args[1]), Allow: allow}
+		if err := app.DB.HostRuleInsert(rule); err != nil {
+			return err
+		}
+		if allow {
+			params.Text = fmt.Sprintf("%s is allowed, including private addresses.", rule.Host)
+		} else {
+			params.Text = fmt.Sprintf("%s is denied.", rule.Host)
+		}
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+// Usage: /hostdel <host>
+func (app *App) HostRuleDeleteHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 2 {
+		params.Text = "Usage: /hostdel <host>"
+	} else if ok, err := app.DB.HostRuleDelete(strings.ToLower(args[1])); err != nil {
+		return err
+	} else if ok {
+		params.Text = fmt.Sprintf("Host rule for %s deleted.", args[1])
+	} else {
+		params.Text = "Host rule does not exist."
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
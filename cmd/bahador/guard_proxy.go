@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// time that connections of the guard proxy have to reach their host
+const guardProxyDialTimeout = 30 * time.Second
+
+// Headers that only apply to one hop of a proxied request.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// A local http proxy for programs that connect by themselves (e.g. yt-dlp).
+// Their connections, including redirects and links that they find in pages,
+// are checked like the requests of the http client and go through the proxy of
+// the job. It listens on the loopback until it's closed.
+type guardProxy struct {
+	app *App
+	// carries the proxy of the job, and is canceled when the proxy is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	ln     net.Listener
+	srv    *http.Server
+	// programs follow redirects themselves, through the proxy again
+	client *http.Client
+}
+
+func (app *App) startGuardProxy(ctx context.Context) (*guardProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &guardProxy{
+		app:    app,
+		ctx:    ctx,
+		cancel: cancel,
+		ln:     ln,
+		client: &http.Client{
+			Transport: app.httpClient.Transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	p.srv = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          app.Log,
+	}
+	go p.srv.Serve(ln)
+	return p, nil
+}
+
+func (p *guardProxy) url() string {
+	return "http://" + p.ln.Addr().String()
+}
+
+// Stops the proxy and closes its tunnels.
+func (p *guardProxy) close() {
+	p.cancel()
+	p.srv.Close()
+}
+
+func (p *guardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	defer context.AfterFunc(r.Context(), cancel)()
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.fail(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, name := range hopHeaders {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *guardProxy) fail(w http.ResponseWriter, err error) {
+	var blockedErr *BlockedAddressError
+	if errors.As(err, &blockedErr) {
+		http.Error(w, blockedErr.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// Handles CONNECT requests, which programs send for https links.
+func (p *guardProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(p.ctx, guardProxyDialTimeout)
+	conn, err := p.dial(ctx, r.Host)
+	cancel()
+	if err != nil {
+		p.fail(w, err)
+		return
+	}
+	defer conn.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnels are not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	defer context.AfterFunc(p.ctx, func() {
+		client.Close()
+		conn.Close()
+	})()
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// bytes that the program sent right after the request
+	if n := buf.Reader.Buffered(); n > 0 {
+		data, _ := buf.Reader.Peek(n)
+		if _, err := conn.Write(data); err != nil {
+			return
+		}
+	}
+	go func() {
+		io.Copy(conn, client)
+		conn.Close()
+	}()
+	io.Copy(client, conn)
+}
+
+// Connects to `address` (host:port) through the proxy that requests to it use,
+// or with the guarded dialer if there is none.
+func (p *guardProxy) dial(ctx context.Context, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "https://"+address, nil)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := p.app.proxyForRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return p.app.dialContext(ctx, "tcp", address)
+	}
+	allowed, err := p.app.checkHost(host)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		if err := p.app.checkResolvedHost(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	return dialThroughProxy(ctx, proxy, address)
+}
+
+// Opens a tunnel to `address` through an http, https or socks5 proxy.
+func dialThroughProxy(ctx context.Context, proxy *url.URL, address string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyDialAddr(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	switch proxy.Scheme {
+	case "https":
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		err = httpConnect(conn, proxy, address)
+	case "http":
+		err = httpConnect(conn, proxy, address)
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, proxy, address)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func httpConnect(conn net.Conn, proxy *url.URL, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// servers of tunnels wait for the client to speak first, so nothing is
+	// buffered after the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused the tunnel: %s", resp.Status)
+	}
+	return nil
+}
+
+// Connects with the CONNECT command of SOCKS5 (RFC 1928), with username and
+// password authentication (RFC 1929) if the proxy url has them. Hosts are
+// resolved by the proxy, like the http client does.
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != 0x05:
+		return errors.New("proxy is not a socks5 proxy")
+	case reply[1] == 0x02 && proxy.User != nil:
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5 username or password is too long")
+		}
+		auth := append([]byte{0x01, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5 authentication failed")
+		}
+	case reply[1] != 0x00:
+		return errors.New("socks5 proxy does not accept any authentication method")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Is4() {
+		req = append(append(req, 0x01), addr.AsSlice()...)
+	} else if err == nil {
+		req = append(append(req, 0x04), addr.AsSlice()...)
+	} else if len(host) <= 255 {
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else {
+		return errors.New("host name is too long")
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type and the first byte of the address
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5 proxy refused the connection: code %d", head[1])
+	}
+	var rest int
+	switch head[3] {
+	case 0x01:
+		rest = net.IPv4len - 1
+	case 0x04:
+		rest = net.IPv6len - 1
+	case 0x03:
+		rest = int(head[4])
+	default:
+		return errors.New("invalid socks5 reply")
+	}
+	// the bound address and port are not used
+	_, err = io.ReadFull(conn, make([]byte, rest+2))
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/thehxdev/bahador/db"
+)
+
+// Starts the guard proxy of the app and returns a client that uses it.
+func startTestGuardProxy(t *testing.T, app *App) (*guardProxy, *http.Client) {
+	t.Helper()
+	p, err := app.startGuardProxy(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	proxyUrl, _ := url.Parse(p.url())
+	return p, &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func localhostTLSUrl(srv *httptest.Server) string {
+	u, _ := url.Parse(srv.URL)
+	return "https://localhost:" + u.Port()
+}
+
+func getBody(t *testing.T, client *http.Client, u string) (int, string, error) {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), nil
+}
+
+func TestGuardProxyBlocksLoopback(t *testing.T) {
+	app := newTestApp(t)
+	_, client := startTestGuardProxy(t, app)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the blocked server")
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	if status, _, err := getBody(t, client, srv.URL); err != nil || status != http.StatusForbidden {
+		t.Errorf("GET %s = %d, %v, want %d", srv.URL, status, err, http.StatusForbidden)
+	}
+	// tunnels are refused, so the client gets an error
+	if _, _, err := getBody(t, client, tlsSrv.URL); err == nil {
+		t.Errorf("GET %s through a tunnel succeeded", tlsSrv.URL)
+	}
+}
+
+func TestGuardProxyAllowedHost(t *testing.T) {
+	app := newTestApp(t)
+	app.DB.HostRuleInsert(db.HostRule{Host: "localhost", Allow: true})
+	_, client := startTestGuardProxy(t, app)
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect reached the blocked server")
+	}))
+	defer blocked.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, blocked.URL, http.StatusFound)
+			return
+		}
+		io.WriteString(w, "media")
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	for _, u := range []string{localhostUrl(srv), localhostTLSUrl(tlsSrv)} {
+		if status, body, err := getBody(t, client, u); err != nil || status != http.StatusOK || body != "media" {
+			t.Errorf("GET %s = %d %q, %v, want 200 %q", u, status, body, err, "media")
+		}
+	}
+	// redirects are followed by the client, through the proxy again
+	if status, _, err := getBody(t, client, localhostUrl(srv)+"/redirect"); err != nil || status != http.StatusForbidden {
+		t.Errorf("GET redirect = %d, %v, want %d", status, err, http.StatusForbidden)
+	}
+}
+
+// Serves SOCKS5 CONNECT requests with username and password authentication.
+func startSOCKS5Server(t *testing.T, username, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	readBytes := func(conn net.Conn, n int) []byte {
+		b := make([]byte, n)
+		io.ReadFull(conn, b)
+		return b
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				head := readBytes(conn, 2)
+				readBytes(conn, int(head[1]))
+				conn.Write([]byte{0x05, 0x02})
+				readBytes(conn, 1)
+				user := string(readBytes(conn, int(readBytes(conn, 1)[0])))
+				pass := string(readBytes(conn, int(readBytes(conn, 1)[0])))
+				if user != username || pass != password {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+				req := readBytes(conn, 4)
+				if req[3] != 0x03 {
+					t.Errorf("socks5 address type = %d, want a domain name", req[3])
+					return
+				}
+				host := string(readBytes(conn, int(readBytes(conn, 1)[0])))
+				port := binary.BigEndian.Uint16(readBytes(conn, 2))
+				target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestGuardProxyThroughProxies(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "media")
+	}))
+	defer srv.Close()
+
+	// the upstream http proxy is another guard proxy that allows localhost
+	upstreamApp := newTestApp(t)
+	upstreamApp.DB.HostRuleInsert(db.HostRule{Host: "localhost", Allow: true})
+	upstream, _ := startTestGuardProxy(t, upstreamApp)
+
+	for _, proxy := range []string{upstream.url(), "socks5h://user:pass@" + startSOCKS5Server(t, "user", "pass")} {
+		app := newTestApp(t)
+		app.globalProxy, _ = url.Parse(proxy)
+		_, client := startTestGuardProxy(t, app)
+
+		// proxies resolve hosts themselves, so hosts are checked before the tunnel
+		if _, _, err := getBody(t, client, localhostTLSUrl(srv)); err == nil {
+			t.Errorf("%s: GET blocked host succeeded", proxy)
+		}
+		app.DB.HostRuleInsert(db.HostRule{Host: "localhost", Allow: true})
+		if status, body, err := getBody(t, client, localhostTLSUrl(srv)); err != nil || status != http.StatusOK || body != "media" {
+			t.Errorf("%s: GET = %d %q, %v, want 200 %q", proxy, status, body, err, "media")
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/thehxdev/bahador/db"
+)
+
+// Returns an app with a new database and the guarded http client, which blocks
+// the default address ranges.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	t.Setenv(proxyEnvVar, "")
+	t.Setenv(blockedCIDRsEnvVar, "")
+	d, err := db.New(filepath.Join(t.TempDir(), "bahador.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.Setup("../../dbschema.sql"); err != nil {
+		t.Fatal(err)
+	}
+	app := &App{DB: d, Log: log.New(io.Discard, "", 0)}
+	if app.httpClient, err = app.newHTTPClient(); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func isBlockedAddressError(err error) bool {
+	var blockedErr *BlockedAddressError
+	return errors.As(err, &blockedErr)
+}
+
+func TestAddrIsBlocked(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fe80::1%eth0", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"fd12:3456::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"172.32.0.1", false},
+		{"8.8.8.8", false},
+		{"::ffff:8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		if got := app.addrIsBlocked(netip.MustParseAddr(tt.addr)); got != tt.blocked {
+			t.Errorf("addrIsBlocked(%s) = %v, want %v", tt.addr, got, tt.blocked)
+		}
+	}
+}
+
+func TestLoadBlockedPrefixes(t *testing.T) {
+	t.Setenv(blockedCIDRsEnvVar, "8.8.8.0/24, 2001:4860::/32")
+	prefixes, err := loadBlockedPrefixes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{blockedPrefixes: prefixes}
+	for _, addr := range []string{"8.8.8.8", "2001:4860::8888", "127.0.0.1"} {
+		if !app.addrIsBlocked(netip.MustParseAddr(addr)) {
+			t.Errorf("%s is not blocked", addr)
+		}
+	}
+
+	t.Setenv(blockedCIDRsEnvVar, "8.8.8.0/33")
+	if _, err := loadBlockedPrefixes(); err == nil {
+		t.Error("invalid CIDR is accepted")
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:443", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[fe80::1%eth0]:80", true},
+		{"169.254.169.254:80", true},
+		{"8.8.8.8:53", false},
+	}
+	for _, tt := range tests {
+		err := app.dialControl("tcp", tt.address, nil)
+		if blocked := isBlockedAddressError(err); blocked != tt.blocked {
+			t.Errorf("dialControl(%s) = %v, want blocked %v", tt.address, err, tt.blocked)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	app := newTestApp(t)
+	app.DB.HostRuleInsert(db.HostRule{Host: "intranet.example", Allow: true})
+	app.DB.HostRuleInsert(db.HostRule{Host: "denied.example", Allow: false})
+	tests := []struct {
+		host    string
+		allowed bool
+		denied  bool
+	}{
+		{"intranet.example", true, false},
+		{"files.intranet.example", true, false},
+		{"denied.example", false, true},
+		{"cdn.denied.example", false, true},
+		{"other.example", false, false},
+	}
+	for _, tt := range tests {
+		allowed, err := app.checkHost(tt.host)
+		if allowed != tt.allowed || isBlockedAddressError(err) != tt.denied {
+			t.Errorf("checkHost(%s) = %v, %v, want %v, denied %v", tt.host, allowed, err, tt.allowed, tt.denied)
+		}
+	}
+}
+
+// Returns the url of the server with "localhost" as its host.
+func localhostUrl(srv *httptest.Server) string {
+	u, _ := url.Parse(srv.URL)
+	return "http://localhost:" + u.Port()
+}
+
+func TestHTTPClientBlocksLoopback(t *testing.T) {
+	app := newTestApp(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the blocked server")
+	}))
+	defer srv.Close()
+
+	for _, u := range []string{srv.URL, localhostUrl(srv), "file:///etc/passwd"} {
+		if _, err := app.httpClient.Get(u); !isBlockedAddressError(err) {
+			t.Errorf("GET %s: err = %v, want a blocked address error", u, err)
+		}
+	}
+}
+
+func TestHTTPClientRedirectToBlockedAddress(t *testing.T) {
+	app := newTestApp(t)
+	// the first server is reached by an allowed host name, and redirects to
+	// an address that is blocked
+	app.DB.HostRuleInsert(db.HostRule{Host: "localhost", Allow: true})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect reached the blocked server")
+	}))
+	defer blocked.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			return
+		}
+		http.Redirect(w, r, blocked.URL+"/secret", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	resp, err := app.httpClient.Get(localhostUrl(srv) + "/ok")
+	if err != nil {
+		t.Fatalf("GET allowed host: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := app.httpClient.Get(localhostUrl(srv) + "/redirect"); !isBlockedAddressError(err) {
+		t.Errorf("GET redirect: err = %v, want a blocked address error", err)
+	}
+}
+
+func TestHTTPClientProxyResolvesHost(t *testing.T) {
+	app := newTestApp(t)
+	var proxied atomic.Int32
+	// proxies are trusted, even on the loopback
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+	}))
+	defer proxy.Close()
+	app.globalProxy, _ = url.Parse(proxy.URL)
+
+	// the proxy would resolve "localhost" itself, so the guard resolves it
+	// before the request is sent
+	if _, err := app.httpClient.Get("http://localhost:1/"); !isBlockedAddressError(err) {
+		t.Errorf("GET through proxy: err = %v, want a blocked address error", err)
+	}
+	if n := proxied.Load(); n != 0 {
+		t.Errorf("proxy got %d requests, want 0", n)
+	}
+
+	app.DB.HostRuleInsert(db.HostRule{Host: "localhost", Allow: true})
+	resp, err := app.httpClient.Get("http://localhost:1/")
+	if err != nil {
+		t.Fatalf("GET allowed host through proxy: %v", err)
+	}
+	resp.Body.Close()
+	if n := proxied.Load(); n != 1 {
+		t.Errorf("proxy got %d requests, want 1", n)
+	}
+}
@@ -2,19 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/bahador/db"
 	"github.com/thehxdev/telbot"
 	conv "github.com/thehxdev/telbot/ext/conversation"
 )
 
-var httpUrlRegexp *regexp.Regexp = regexp.MustCompile(`https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()@:%_\+.~#?&//=]*)`)
-
 func (app *App) StartHandler(update telbot.Update) error {
 	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
 		ChatId: update.ChatId(),
@@ -31,132 +29,369 @@ func (app *App) SelfHandler(update telbot.Update) error {
 	return err
 }
 
+// Usage: /up [at <time> | in <duration>]
 func (app *App) UploadCommandHandler(c *conv.Conversation, update telbot.Update) error {
+	startAt, ok := app.startTimeFromCommand(update)
+	if !ok {
+		return &conv.EndConversation{}
+	}
+	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   "Send a download link.\nHTTP headers (e.g. Authorization or Cookie) can be added as extra lines in \"Name: value\" form.\nUse a \"proxy=<name>\" line to download through one of /proxies and a \"name=<file name>\" line to rename the file.\nAdd an \"extract=true\" line to extract an archive and upload its files separately.\nAdd an \"at=<time>\" or \"in=<duration>\" line to start the job later.\nMagnet and .torrent links are supported too.",
+	})
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		return app.LinksMessageHandler(c, update, startAt)
+	}
+	return err
+}
+
+// Usage: /uph [at <time> | in <duration>]
+func (app *App) UploadWithHeadersCommandHandler(c *conv.Conversation, update telbot.Update) error {
+	startAt, ok := app.startTimeFromCommand(update)
+	if !ok {
+		return &conv.EndConversation{}
+	}
 	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
 		ChatId: update.ChatId(),
 		Text:   "Send a download link.",
 	})
-	c.Next = app.LinksMessageHandler
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		return app.LinkBeforeHeadersMessageHandler(c, update, startAt)
+	}
 	return err
 }
 
-func (app *App) JobCancelHandler(update telbot.Update) error {
-	jobIdStr, _ := strings.CutPrefix(update.Message.Text, "/cancel")
-	jobId, err := strconv.ParseInt(jobIdStr, 10, 64)
-	if err != nil {
-		return err
+// Jobs start at `startAt` if it's not zero, unless the links message sets another time.
+func (app *App) LinksMessageHandler(c *conv.Conversation, update telbot.Update, startAt time.Time) error {
+	if job, ok := app.jobFromLinkMessage(update); ok {
+		if job.startAt.IsZero() {
+			job.startAt = startAt
+		}
+		return app.startJob(c, update, job)
+	}
+	return &conv.EndConversation{}
+}
+
+func (app *App) LinkBeforeHeadersMessageHandler(c *conv.Conversation, update telbot.Update, startAt time.Time) error {
+	job, ok := app.jobFromLinkMessage(update)
+	if !ok {
+		return &conv.EndConversation{}
 	}
-	var msgText string
-	if cancelChan, ok := app.jobMap[jobId]; ok {
-		close(cancelChan)
-		delete(app.jobMap, jobId)
-		msgText = fmt.Sprintf("Job %d canceled.", jobId)
-	} else {
-		msgText = "Job does not exist."
+	if job.startAt.IsZero() {
+		job.startAt = startAt
 	}
-	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
 		ChatId: update.ChatId(),
-		Text:   msgText,
+		Text:   "Send HTTP headers, one \"Name: value\" per line.",
 	})
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		header, err := parseHeaderLines(strings.Split(update.Message.Text, "\n"))
+		if err != nil {
+			app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+				ChatId:           update.ChatId(),
+				Text:             err.Error(),
+				ReplyToMessageId: update.MessageId(),
+			})
+			return &conv.EndConversation{}
+		}
+		for name, values := range header {
+			job.header[name] = values
+		}
+		// scheduled jobs are created again from the message
+		job.message += "\n" + update.Message.Text
+		return app.startJob(c, update, job)
+	}
 	return err
 }
 
-func (app *App) LinksMessageHandler(c *conv.Conversation, update telbot.Update) error {
+// Runs or schedules the job. Users choose what to download first, if the job's source
+// is a `Chooser`.
+func (app *App) startJob(c *conv.Conversation, update telbot.Update, job dlJob) error {
+	chooser, ok := job.source.(Chooser)
+	if !ok {
+		if !job.startAt.IsZero() {
+			return app.scheduleJob(update, job, "")
+		}
+		return app.runConversationJob(c, update, job)
+	}
+
+	params := telbot.TextMessageParams{
+		ChatId:           update.ChatId(),
+		ReplyToMessageId: update.MessageId(),
+	}
+	question, err := chooser.Question(withJobProxy(context.Background(), job.proxy))
+	if err != nil {
+		app.Log.Println(err)
+		params.Text = userErrorText(err)
+		app.Bot.SendMessage(context.Background(), params)
+		return &conv.EndConversation{}
+	}
+	if question == "" {
+		if !job.startAt.IsZero() {
+			return app.scheduleJob(update, job, "")
+		}
+		return app.runConversationJob(c, update, job)
+	}
+
+	params.Text = question
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		if err := chooser.Choose(update.Message.Text); err != nil {
+			app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+				ChatId:           update.ChatId(),
+				Text:             err.Error(),
+				ReplyToMessageId: update.MessageId(),
+			})
+			return &conv.EndConversation{}
+		}
+		job.answer = update.Message.Text
+		if !job.startAt.IsZero() {
+			return app.scheduleJob(update, job, job.answer)
+		}
+		return app.runConversationJob(c, update, job)
+	}
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+// Runs the job and ends the conversation when it's done. Jobs that extract
+// archives may ask which files to upload, and the conversation takes the answers
+// while they run.
+func (app *App) runConversationJob(c *conv.Conversation, update telbot.Update, job dlJob) error {
+	if job.extract {
+		job.ask = app.jobAsker(c, update)
+	}
+	app.runJob(update.ChatId(), update.MessageId(), job)
+	return &conv.EndConversation{}
+}
+
+// Creates a job from a links message. Users get a reply describing the problem
+// if the message is not valid.
+func (app *App) jobFromLinkMessage(update telbot.Update) (dlJob, bool) {
 	params := telbot.TextMessageParams{ChatId: update.ChatId()}
 
 	if update.Message.Text == "" {
 		params.Text = "Your message does not contain any text data."
 		app.Bot.SendMessage(context.Background(), params)
-		return &conv.EndConversation{}
+		return dlJob{}, false
 	}
 
-	if !httpUrlRegexp.MatchString(update.Message.Text) {
-		params.Text = "Your message does not match to a valid HTTPS URL."
-		params.ReplyToMessageId = update.MessageId()
+	params.ReplyToMessageId = update.MessageId()
+	job, err := app.newLinkJob(update.UserId(), update.Message.Text)
+	if err != nil {
+		params.Text = err.Error()
 		app.Bot.SendMessage(context.Background(), params)
-		return &conv.EndConversation{}
+		return dlJob{}, false
+	}
+	return job, true
+}
+
+// Returns errors that can be shown to the user.
+func (app *App) newLinkJob(userId int, text string) (dlJob, error) {
+	link, header, opts, err := parseLinkMessage(text)
+	if err != nil {
+		return dlJob{}, err
+	}
+
+	// headers sent by user take precedence over stored credentials. Jobs don't
+	// run without the credentials, because servers would answer with errors or
+	// with a different file.
+	jobHeader, err := app.credentialHeaders(link)
+	if err != nil {
+		app.Log.Println(err)
+		return dlJob{}, ErrCredentialProfile
+	}
+	for name, values := range header {
+		jobHeader[name] = values
 	}
 
 	job := dlJob{
-		url:        update.Message.Text,
+		userId:     userId,
+		url:        link,
+		header:     jobHeader,
+		fileName:   opts.fileName,
+		extract:    opts.extract,
+		startAt:    opts.startAt,
+		message:    text,
 		resChan:    make(chan jobResult, 1),
 		cancelChan: make(chan struct{}, 1),
 	}
 
-	// FIXME: handle collision (same jobId with another jobId)
-	jobId, _ := utils.GenRandInt64(0, 0x7FFFFFFFFFFFFFFF)
-	app.jobMap[jobId] = job.cancelChan
+	if opts.proxy != "" {
+		job.proxy, err = app.jobProxy(opts.proxy)
+		if err != nil {
+			return dlJob{}, err
+		}
+	}
 
-	chatId := update.ChatId()
-	statSuffix := fmt.Sprintf("\n/cancel%d", jobId)
+	job.source, err = app.newSource(&job)
+	if err != nil {
+		return dlJob{}, err
+	}
+
+	return job, nil
+}
+
+// Runs the job and shows its status in a reply to message `replyTo`. Paused jobs
+// wait here until they are resumed or canceled.
+func (app *App) runJob(chatId, replyTo int, job dlJob) {
+	app.jobMu.Lock()
+	closing := app.closing.Load()
+	if !closing {
+		app.jobWg.Add(1)
+	}
+	app.jobMu.Unlock()
+	if closing {
+		app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+			ChatId:           chatId,
+			Text:             shutdownText,
+			ReplyToMessageId: replyTo,
+		})
+		return
+	}
+	defer app.jobWg.Done()
+	if job.progress == nil {
+		job.progress = newJobProgress()
+	}
+	e := &jobEntry{chatId: chatId, replyTo: replyTo, job: job, resumeChan: make(chan struct{}, 1)}
+	jobId := app.addJobEntry(e)
+	job.id = jobId
+	keyboard := jobKeyboard(jobId, "pause", "cancel")
 
-	statMsg, _ := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+	statMsg, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
 		ChatId:           chatId,
-		Text:             "Processing URL..." + statSuffix,
-		ReplyToMessageId: update.MessageId(),
+		Text:             "Processing URL...",
+		ReplyToMessageId: replyTo,
+		ReplyMarkup:      keyboard,
 	})
+	if err != nil {
+		app.Log.Println(err)
+		app.removeJobEntry(jobId)
+		return
+	}
+	e.msgId = statMsg.Id
 
 	job.eventLogger = func(format string, v ...any) {
 		var logText string
 		if len(v) > 0 {
-			logText = fmt.Sprintf(format, v)
+			logText = fmt.Sprintf(format, v...)
 		} else {
 			logText = fmt.Sprint(format)
 		}
 		app.Log.Println(logText)
-		app.Bot.EditMessageText(context.Background(), telbot.EditMessageTextParams{
-			ChatId:    chatId,
-			MessageId: statMsg.Id,
-			Text:      logText + statSuffix,
-		})
+		app.editJobStatus(chatId, statMsg.Id, logText, keyboard)
 	}
 
-	app.jobChan <- job
+	var res jobResult
+	for {
+		app.jobMu.Lock()
+		e.state = jobRunning
+		e.pauseChan = make(chan struct{})
+		job.pauseChan = e.pauseChan
+		app.jobMu.Unlock()
 
-	res := <-job.resChan
-	close(job.resChan)
+		if app.enqueueJob(job) {
+			res = <-job.resChan
+		} else {
+			// the queue is closed by shutdown, which checkpoints the job
+			res = jobResult{paused: true}
+		}
+		if !res.paused {
+			break
+		}
 
-	select {
-	case _, ok := <-job.cancelChan:
-		if ok {
-			close(job.cancelChan)
+		app.jobMu.Lock()
+		// resumes that were requested before the job was paused
+		select {
+		case <-e.resumeChan:
+		default:
 		}
-	default:
+		e.state = jobPaused
+		app.jobMu.Unlock()
+		if app.closing.Load() {
+			// the job is checkpointed by shutdown
+			return
+		}
+		app.editJobStatus(chatId, statMsg.Id, "Paused.", jobKeyboard(jobId, "resume", "cancel"))
+		select {
+		case <-e.resumeChan:
+			app.editJobStatus(chatId, statMsg.Id, "Resuming...", keyboard)
+			continue
+		case <-job.cancelChan:
+			job.progress.remove()
+			res.error = context.Canceled
+		case <-time.After(pausedJobTTL):
+			// files of the job and their disk space are not kept forever
+			job.progress.remove()
+			res.error = ErrPausedTooLong
+		case <-app.ctx.Done():
+			// the job is checkpointed by shutdown
+			return
+		}
+		break
 	}
+	close(job.resChan)
 
-	delete(app.jobMap, jobId)
-
-	var urls []string
-	var statText string
 	if err := res.error; err != nil {
 		app.Log.Println(err)
-		switch err.(type) {
-		case *EmptyFileNameError:
-			statText = err.Error()
-		case *MaxFileSizeError:
-			statText = err.Error()
-		case *IncompleteDownloadError:
-			statText = err.Error()
-		case *NonZeroStatusError:
-			statText = err.Error()
-		default:
-			statText = "failed to download file (probably internal server error)"
-		}
-		goto done
+		statText := userErrorText(err)
+		app.markJobFailed(jobId, e, statText)
+		app.editJobStatus(chatId, statMsg.Id, statText, jobKeyboard(jobId, "retry"))
+		return
 	}
+	app.removeJobEntry(jobId)
 
-	urls = []string{}
+	finishedId, err := app.DB.FinishedJobInsert(db.FinishedJob{
+		UserId:   job.userId,
+		CacheKey: job.progress.cacheKey,
+		Date:     time.Now().Unix(),
+		FileIds:  res.fileIds,
+	})
+	if err != nil {
+		app.Log.Println(err)
+	}
+	urls := []string{}
 	for _, fileId := range res.fileIds {
-		u, _ := url.JoinPath(app.Bot.BaseFileUrl, fileId)
+		u, err := app.fileLink(context.Background(), job.userId, fileId)
+		if err != nil {
+			app.Log.Println(err)
+			continue
+		}
 		urls = append(urls, u)
 	}
-	statText = strings.Join(urls, "\n\n")
+	text := strings.Join(urls, "\n\n")
+	if finishedId > 0 && len(urls) > 0 {
+		text += fmt.Sprintf("\n\n/revoke %d takes the links back and /delete %d deletes the files.", finishedId, finishedId)
+	}
+	app.editJobStatus(chatId, statMsg.Id, text, nil)
+}
 
-done:
-	app.Bot.EditMessageText(context.Background(), telbot.EditMessageTextParams{
-		ChatId:    chatId,
-		MessageId: statMsg.Id,
-		Text:      statText,
-	})
-	return &conv.EndConversation{}
+// Returns the text that users see for an error of a job. Details of internal
+// errors are only logged.
+func userErrorText(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "job canceled"
+	}
+	// http client wraps the errors of the dialer
+	var blockedErr *BlockedAddressError
+	if errors.As(err, &blockedErr) {
+		err = blockedErr
+	}
+	switch err.(type) {
+	case *EmptyFileNameError,
+		*MaxFileSizeError,
+		*IncompleteDownloadError,
+		*IncompleteUploadError,
+		*NonZeroStatusError,
+		*BlockedAddressError,
+		*HostKeyMismatchError,
+		*NotRegularFileError,
+		*InvalidTorrentError,
+		*TorrentProxyError,
+		*InvalidSelectionError,
+		*EmptyArchiveError,
+		*NoAnswerError,
+		*PausedTooLongError:
+		return err.Error()
+	}
+	return "failed to download file (probably internal server error)"
 }
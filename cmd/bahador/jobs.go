@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/telbot"
+	"github.com/thehxdev/telbot/types"
+)
+
+const (
+	// how long failed jobs can be retried
+	failedJobTTL = time.Hour
+	// how long paused jobs keep their files, before they fail
+	pausedJobTTL = 24 * time.Hour
+)
+
+type jobState int
+
+const (
+	jobRunning jobState = iota
+	// pause is requested, but the job is still running
+	jobPausing
+	jobPaused
+	// the job returned its result, which is not handled yet
+	jobFinished
+	jobFailed
+)
+
+// What a job has done so far. It's kept between the runs of a paused job, so the
+// job continues where it stopped.
+type jobProgress struct {
+	tmpDir string
+	// downloaded (or partially downloaded) file
+	filePath   string
+	fileSize   int64
+	downloaded bool
+	// ETag or Last-Modified of HTTP files, which partial files are continued with
+	validator string
+	// archive parts of files, by archive path
+	parts map[string][]string
+	// file ids of uploaded files and parts, by path
+	uploaded map[string]string
+	// extracted files, the ones that are selected for upload and file ids of the
+	// ones that are uploaded
+	extracted    []extractedFile
+	entries      []extractedFile
+	entryFileIds [][]string
+	// key of the downloaded file in the cache, if it can be cached
+	cacheKey string
+	// disk space reserved for the files
+	disk     *diskBudget
+	reserved int64
+}
+
+func newJobProgress() *jobProgress {
+	return &jobProgress{
+		parts:    map[string][]string{},
+		uploaded: map[string]string{},
+	}
+}
+
+// Returns the temporary directory of the job. It's created on first call.
+func (p *jobProgress) dir() (string, error) {
+	if p.tmpDir == "" {
+		tmpDir, err := os.MkdirTemp(workDir, workDirPattern)
+		if err != nil {
+			return "", err
+		}
+		p.tmpDir = tmpDir
+	}
+	return p.tmpDir, nil
+}
+
+// Removes the files of the job and releases its disk space. Jobs start from
+// scratch after that.
+func (p *jobProgress) remove() {
+	if p.tmpDir != "" {
+		os.RemoveAll(p.tmpDir)
+	}
+	if p.disk != nil {
+		p.disk.release(p.reserved)
+	}
+	*p = *newJobProgress()
+}
+
+// A job that is running, paused or failed. Its status message has the buttons that
+// control it.
+type jobEntry struct {
+	job     dlJob
+	chatId  int
+	replyTo int
+	// id of the status message
+	msgId int
+	// text of the status message after the job failed
+	status string
+	state  jobState
+	// closed to pause the current run of the job
+	pauseChan  chan struct{}
+	resumeChan chan struct{}
+
+	cancelOnce sync.Once
+}
+
+func (e *jobEntry) cancel() {
+	e.cancelOnce.Do(func() { close(e.job.cancelChan) })
+}
+
+func (app *App) jobState(e *jobEntry) jobState {
+	app.jobMu.Lock()
+	defer app.jobMu.Unlock()
+	return e.state
+}
+
+func (app *App) setJobState(jobId int64, state jobState) {
+	app.jobMu.Lock()
+	if e, ok := app.jobMap[jobId]; ok {
+		e.state = state
+	}
+	app.jobMu.Unlock()
+}
+
+// Stores the entry with a new random job id, which is set in its job before
+// callbacks can find it.
+func (app *App) addJobEntry(e *jobEntry) int64 {
+	app.jobMu.Lock()
+	defer app.jobMu.Unlock()
+	for {
+		jobId, _ := utils.GenRandInt64(0, 0x7FFFFFFFFFFFFFFF)
+		if _, ok := app.jobMap[jobId]; !ok {
+			e.job.id = jobId
+			app.jobMap[jobId] = e
+			return jobId
+		}
+	}
+}
+
+func (app *App) jobEntry(jobId int64) (*jobEntry, bool) {
+	app.jobMu.Lock()
+	defer app.jobMu.Unlock()
+	e, ok := app.jobMap[jobId]
+	return e, ok
+}
+
+func (app *App) removeJobEntry(jobId int64) {
+	app.jobMu.Lock()
+	delete(app.jobMap, jobId)
+	app.jobMu.Unlock()
+}
+
+// Failed jobs are kept until they are retried or `failedJobTTL` passes. Their
+// progress is removed after that.
+func (app *App) markJobFailed(jobId int64, e *jobEntry, status string) {
+	app.jobMu.Lock()
+	e.state, e.status = jobFailed, status
+	app.jobMu.Unlock()
+	time.AfterFunc(failedJobTTL, func() {
+		app.jobMu.Lock()
+		_, ok := app.jobMap[jobId]
+		delete(app.jobMap, jobId)
+		app.jobMu.Unlock()
+		if !ok {
+			// the job is retried
+			return
+		}
+		e.job.progress.remove()
+		// remove the retry button
+		app.editJobStatus(e.chatId, e.msgId, status, nil)
+	})
+}
+
+type inlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type inlineKeyboardMarkup struct {
+	InlineKeyboard [][]inlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// Callback data of buttons is `<action>:<job id>`.
+func jobKeyboard(jobId int64, actions ...string) *inlineKeyboardMarkup {
+	row := []inlineKeyboardButton{}
+	for _, action := range actions {
+		row = append(row, inlineKeyboardButton{
+			Text:         strings.ToUpper(action[:1]) + action[1:],
+			CallbackData: fmt.Sprintf("%s:%d", action, jobId),
+		})
+	}
+	return &inlineKeyboardMarkup{InlineKeyboard: [][]inlineKeyboardButton{row}}
+}
+
+// `telbot.EditMessageTextParams` does not support reply markups.
+type editMessageTextParams struct {
+	telbot.EditMessageTextParams
+	ReplyMarkup *inlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// Edits the status message of a job. Buttons are removed if `keyboard` is nil.
+func (app *App) editJobStatus(chatId, msgId int, text string, keyboard *inlineKeyboardMarkup) {
+	body, _ := telbot.ParamsToReader(editMessageTextParams{
+		EditMessageTextParams: telbot.EditMessageTextParams{
+			ChatId:    chatId,
+			MessageId: msgId,
+			Text:      text,
+		},
+		ReplyMarkup: keyboard,
+	})
+	_, err := app.Bot.SendRequest(context.Background(), app.Bot.BaseUrl, telbot.RequestInfo{
+		Method:      telbot.MethodEditMessageText,
+		Body:        body,
+		ContentType: telbot.ContentTypeApplicationJson,
+	})
+	if err != nil {
+		app.Log.Println(err)
+	}
+}
+
+func (app *App) answerCallbackQuery(queryId, text string) error {
+	body, _ := telbot.ParamsToReader(map[string]string{
+		"callback_query_id": queryId,
+		"text":              text,
+	})
+	_, err := app.Bot.SendRequest(context.Background(), app.Bot.BaseUrl, telbot.RequestInfo{
+		Method:      "answerCallbackQuery",
+		Body:        body,
+		ContentType: telbot.ContentTypeApplicationJson,
+	})
+	return err
+}
+
+// Handles the buttons of job status messages. Only the owner of the job and
+// admins can press them.
+func (app *App) CallbackQueryHandler(query *types.CallbackQuery) error {
+	action, jobIdStr, _ := strings.Cut(query.Data, ":")
+	jobId, err := strconv.ParseInt(jobIdStr, 10, 64)
+	if err != nil {
+		return app.answerCallbackQuery(query.Id, "Invalid button.")
+	}
+	e, ok := app.jobEntry(jobId)
+	if !ok {
+		return app.answerCallbackQuery(query.Id, "Job does not exist.")
+	}
+	if e.job.userId != query.From.Id {
+		if u, err := app.DB.UserAuthenticate(query.From.Id); err != nil || !u.IsAdmin {
+			return app.answerCallbackQuery(query.Id, "This job is not yours.")
+		}
+	}
+
+	// jobs are checkpointed as they are when the bot is shutting down
+	if app.closing.Load() {
+		return app.answerCallbackQuery(query.Id, "Bot is shutting down.")
+	}
+
+	var text string
+	switch action {
+	case "cancel":
+		text = app.cancelJob(jobId, e)
+	case "pause":
+		text = app.pauseJob(e)
+	case "resume":
+		text = app.resumeJob(e)
+	case "retry":
+		text = app.retryJob(jobId, e)
+	default:
+		text = "Invalid button."
+	}
+	return app.answerCallbackQuery(query.Id, text)
+}
+
+func (app *App) cancelJob(jobId int64, e *jobEntry) string {
+	if state := app.jobState(e); state == jobFinished || state == jobFailed {
+		return "Job is already finished."
+	}
+	e.cancel()
+	return "Job canceled."
+}
+
+func (app *App) pauseJob(e *jobEntry) string {
+	app.jobMu.Lock()
+	defer app.jobMu.Unlock()
+	if e.state != jobRunning {
+		return "Job is not running."
+	}
+	e.state = jobPausing
+	close(e.pauseChan)
+	return "Pausing the job."
+}
+
+func (app *App) resumeJob(e *jobEntry) string {
+	app.jobMu.Lock()
+	defer app.jobMu.Unlock()
+	if e.state != jobPaused {
+		return "Job is not paused."
+	}
+	select {
+	case e.resumeChan <- struct{}{}:
+	default:
+	}
+	return "Resuming the job."
+}
+
+func (app *App) retryJob(jobId int64, e *jobEntry) string {
+	app.jobMu.Lock()
+	_, ok := app.jobMap[jobId]
+	ok = ok && e.state == jobFailed
+	delete(app.jobMap, jobId)
+	app.jobMu.Unlock()
+	if !ok {
+		return "Job can't be retried."
+	}
+
+	app.editJobStatus(e.chatId, e.msgId, e.status, nil)
+	job := e.job
+	// the conversation that asked the questions of the job is over
+	job.ask = nil
+	job.resChan = make(chan jobResult, 1)
+	job.cancelChan = make(chan struct{}, 1)
+	go app.runJob(e.chatId, e.replyTo, job)
+	return "Retrying the job."
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/thehxdev/telbot"
+)
+
+const (
+	workersEnvVar      string = "BAHADOR_WORKERS"
+	maxDownloadsEnvVar string = "BAHADOR_MAX_DOWNLOADS"
+	maxArchiversEnvVar string = "BAHADOR_MAX_ARCHIVERS"
+	maxUploadsEnvVar   string = "BAHADOR_MAX_UPLOADS"
+
+	defaultMaxDownloads int = 5
+	defaultMaxArchivers int = 2
+	defaultMaxUploads   int = 4
+	// parts of one job that are uploaded at the same time
+	partUploadsPerJob int = 3
+)
+
+// A semaphore whose limit can be changed while it's in use. Holders keep their
+// slots when the limit is lowered.
+type limiter struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+	// closed and replaced when a slot may be available
+	changed chan struct{}
+}
+
+func newLimiter(limit int) *limiter {
+	return &limiter{limit: limit, changed: make(chan struct{})}
+}
+
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.used < l.limit {
+			l.used++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.used--
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+func (l *limiter) stat() (used, limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used, l.limit
+}
+
+// must be called with l.mu held
+func (l *limiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Limits of the resources that jobs compete for: network for downloads, CPU for
+// 7z processes and Bot API for uploads.
+type jobLimits struct {
+	downloads *limiter
+	archivers *limiter
+	uploads   *limiter
+}
+
+func loadJobLimits() (jobLimits, error) {
+	limits := jobLimits{}
+	for _, l := range []struct {
+		dst          **limiter
+		envVar       string
+		defaultLimit int
+	}{
+		{&limits.downloads, maxDownloadsEnvVar, defaultMaxDownloads},
+		{&limits.archivers, maxArchiversEnvVar, defaultMaxArchivers},
+		{&limits.uploads, maxUploadsEnvVar, defaultMaxUploads},
+	} {
+		n, err := envPositiveInt(l.envVar, l.defaultLimit)
+		if err != nil {
+			return limits, err
+		}
+		*l.dst = newLimiter(n)
+	}
+	return limits, nil
+}
+
+func envPositiveInt(key string, defaultValue int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s: must be a positive number", key)
+	}
+	return n, nil
+}
+
+// Runs `fn` while holding a slot of the limiter.
+func withLimit(ctx context.Context, l *limiter, fn func() error) error {
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+	defer l.release()
+	return fn()
+}
+
+// Starts or stops workers until there are `n` of them. Stopped workers finish
+// their current job first. No workers are started while shutting down.
+func (app *App) setWorkersCount(n int) {
+	app.workerMu.Lock()
+	defer app.workerMu.Unlock()
+	if app.closing.Load() {
+		n = 0
+	}
+	for len(app.workerStops) < n {
+		stopCtx, stop := context.WithCancel(app.ctx)
+		app.workerStops = append(app.workerStops, stop)
+		app.workerWg.Add(1)
+		go func() {
+			defer app.workerWg.Done()
+			app.worker(app.ctx, stopCtx)
+		}()
+	}
+	for len(app.workerStops) > n {
+		last := len(app.workerStops) - 1
+		app.workerStops[last]()
+		app.workerStops = app.workerStops[:last]
+	}
+}
+
+func (app *App) workersCount() int {
+	app.workerMu.Lock()
+	defer app.workerMu.Unlock()
+	return len(app.workerStops)
+}
+
+// Usage: /limits
+func (app *App) LimitListHandler(update telbot.Update) error {
+	lines := []string{fmt.Sprintf("workers: %d", app.workersCount())}
+	for _, l := range []struct {
+		name    string
+		limiter *limiter
+	}{
+		{"downloads", app.limits.downloads},
+		{"archivers", app.limits.archivers},
+		{"uploads", app.limits.uploads},
+	} {
+		used, limit := l.limiter.stat()
+		lines = append(lines, fmt.Sprintf("%s: %d (%d in use)", l.name, limit, used))
+	}
+	reserved, cached, budget := app.disk.stat()
+	diskLine := fmt.Sprintf("disk: %s reserved, %s cached", humanize.IBytes(uint64(reserved)), humanize.IBytes(uint64(cached)))
+	if budget > 0 {
+		diskLine = fmt.Sprintf("disk: %s (%s reserved, %s cached)", humanize.IBytes(uint64(budget)), humanize.IBytes(uint64(reserved)), humanize.IBytes(uint64(cached)))
+	}
+	lines = append(lines, diskLine)
+	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   strings.Join(lines, "\n"),
+	})
+	return err
+}
+
+// Usage: /limit <workers|downloads|archivers|uploads> <n>
+// Changes are not saved. Limits are loaded from environment variables on start.
+func (app *App) LimitSetHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	n := 0
+	var err error
+	if len(args) == 3 {
+		n, err = strconv.Atoi(args[2])
+	}
+	if len(args) != 3 || err != nil || n < 1 {
+		params.Text = "Usage: /limit <workers|downloads|archivers|uploads> <n>"
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	switch args[1] {
+	case "workers":
+		app.setWorkersCount(n)
+	case "downloads":
+		app.limits.downloads.setLimit(n)
+	case "archivers":
+		app.limits.archivers.setLimit(n)
+	case "uploads":
+		app.limits.uploads.setLimit(n)
+	default:
+		params.Text = "Usage: /limit <workers|downloads|archivers|uploads> <n>"
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+	params.Text = fmt.Sprintf("Limit of %s is set to %d.", args[1], n)
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
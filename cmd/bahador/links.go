@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options that users can set for a job with `key=value` lines in a links message.
+type jobOptions struct {
+	// name of a proxy defined by admins
+	proxy string
+	// overrides the file name from server
+	fileName string
+	// extract the downloaded archive and upload its files
+	extract bool
+	// job is scheduled to start at this time, if it's not zero
+	startAt time.Time
+}
+
+// Parses a links message. The first line is the download link and every other
+// non-empty line is either an HTTP header in `Name: value` form or a job option
+// in `key=value` form.
+func parseLinkMessage(text string) (link string, header http.Header, opts jobOptions, err error) {
+	link, rest, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	link = strings.TrimSpace(link)
+	header = http.Header{}
+	for line := range strings.SplitSeq(rest, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if name, value, ok := parseHeaderLine(line); ok {
+			header.Add(name, value)
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			err = ErrInvalidHeader
+			return
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "proxy":
+			opts.proxy = value
+		case "name":
+			if opts.fileName = sanitizeFileName(value); opts.fileName == "" {
+				err = ErrEmptyFileName
+				return
+			}
+		case "extract":
+			if opts.extract, err = strconv.ParseBool(value); err != nil {
+				err = ErrInvalidOption
+				return
+			}
+		case "at", "in":
+			if opts.startAt, err = parseStartTime(strings.TrimSpace(key), value, time.Now()); err != nil {
+				return
+			}
+		default:
+			err = ErrInvalidOption
+			return
+		}
+	}
+	return
+}
+
+func parseHeaderLines(lines []string) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := parseHeaderLine(line)
+		if !ok {
+			return nil, ErrInvalidHeader
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+func parseHeaderLine(line string) (string, string, bool) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok || !isHeaderName(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(value), true
+}
+
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -13,7 +13,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"strings"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	dbpkg "github.com/thehxdev/bahador/db"
@@ -38,26 +38,40 @@ func main() {
 
 	flag.StringVar(&dbSchemaPath, "dbschema", defaultDBSchemaPath, "path to a file that defines database schema")
 	addUser := flag.Int("add-user", -1, "add a new user to database")
+	addAdmin := flag.Bool("admin", false, "add the user as an admin (used with -add-user)")
 	flag.Parse()
 
 	appCtx, appCancel := context.WithCancel(context.Background())
 	app, err := AppNew(appCtx)
 	utils.MustBeNil(err)
+	shutdownGrace, err := loadShutdownGrace()
+	utils.MustBeNil(err)
 	db := app.DB
 
 	if *addUser > 0 {
 		utils.MustBeNil(db.UserInsert(dbpkg.User{
 			UserId:  *addUser,
-			IsAdmin: false,
+			IsAdmin: *addAdmin,
 		}))
 		return
 	}
 
+	// files of jobs that were running when the bot crashed
+	utils.MustBeNil(cleanWorkDir(db))
 	utils.MustBeNil(app.InitBot(appCtx))
 	bot := app.Bot
+	// scheduler and watcher stop first, so they don't start jobs while shutting down
+	servicesCtx, stopServices := context.WithCancel(appCtx)
+	go app.scheduler(servicesCtx)
+	go app.watcher(servicesCtx)
+	go app.bandwidthScheduler(servicesCtx)
+	if app.files != nil {
+		utils.MustBeNil(app.files.start(appCtx))
+	}
 
+	shutdownDone := make(chan struct{})
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigChan
 		go func() {
@@ -66,47 +80,123 @@ func main() {
 			os.Exit(1)
 		}()
 		app.Log.Println("shutting down")
+		stopServices()
+		app.Shutdown(shutdownGrace)
+		appCancel()
+		app.waitJobResults()
+		// jobs and handlers use the database until this point
 		if err := db.Close(); err != nil {
 			db.Log.Println(err)
 		}
-		appCancel()
+		close(shutdownDone)
 	}()
 
 	updatesChan, err := bot.StartPolling(appCtx, telbot.UpdateParams{
 		Offset:         0,
 		Limit:          getUpdatesLimit,
 		Timeout:        getUpdatesTimeout,
-		AllowedUpdates: []string{"message"},
+		AllowedUpdates: []string{"message", "callback_query"},
 	})
 	if err != nil {
 		app.Log.Fatal(err)
 	}
 
 	uploadWithAuthHandler := app.ConvAuthMiddleware(app.UploadCommandHandler)
+	uploadWithHeadersHandler := app.ConvAuthMiddleware(app.UploadWithHeadersCommandHandler)
+	sshAddHandler := app.ConvAdminAuthMiddleware(app.SSHAddCommandHandler)
+	filesHandler := app.ConvAuthMiddleware(app.FilesCommandHandler)
 
 	go func() {
 		app.Log.Println("polling updates")
 		for update := range updatesChan {
+			if update.CallbackQuery != nil {
+				go func() {
+					if err := app.CallbackQueryHandler(update.CallbackQuery); err != nil {
+						app.Log.Println(err)
+					}
+				}()
+				continue
+			}
 			if !updateIsValid(update) {
 				continue
 			}
+			if app.closing.Load() {
+				go func() {
+					if err := app.ShutdownHandler(update); err != nil {
+						app.Log.Println(err)
+					}
+				}()
+				continue
+			}
 
 			go func() {
 				var err error
 				if update.Message.IsCommand() {
-					text := update.Message.Text
-					if strings.HasPrefix(text, "/cancel") {
-						err = app.JobCancelHandler(update)
-					} else {
-						switch text {
-						case "/start":
-							err = app.StartHandler(update)
-						case "/self":
-							err = app.SelfHandler(update)
-						case "/up":
-							conv.Start(uploadWithAuthHandler, update)
-						default:
-						}
+					command, _ := update.Message.Command()
+					switch command {
+					case "start":
+						err = app.StartHandler(update)
+					case "self":
+						err = app.SelfHandler(update)
+					case "up":
+						conv.Start(uploadWithAuthHandler, update)
+					case "uph":
+						conv.Start(uploadWithHeadersHandler, update)
+					case "files":
+						conv.Start(filesHandler, update)
+					case "scheduled":
+						err = app.ScheduledListHandler(update)
+					case "unschedule":
+						err = app.UnscheduleHandler(update)
+					case "revoke":
+						err = app.RevokeHandler(update)
+					case "delete":
+						err = app.DeleteHandler(update)
+					case "limits":
+						err = app.AdminAuthMiddleware(app.LimitListHandler)(update)
+					case "limit":
+						err = app.AdminAuthMiddleware(app.LimitSetHandler)(update)
+					case "bandwidth":
+						err = app.AdminAuthMiddleware(app.BandwidthHandler)(update)
+					case "watch":
+						err = app.WatchAddHandler(update)
+					case "watches":
+						err = app.WatchListHandler(update)
+					case "unwatch":
+						err = app.WatchDeleteHandler(update)
+					case "credadd":
+						err = app.AdminAuthMiddleware(app.CredentialAddHandler)(update)
+					case "creds":
+						err = app.AdminAuthMiddleware(app.CredentialListHandler)(update)
+					case "creddel":
+						err = app.AdminAuthMiddleware(app.CredentialDeleteHandler)(update)
+					case "proxies":
+						err = app.ProxyListHandler(update)
+					case "proxyadd":
+						err = app.AdminAuthMiddleware(app.ProxyAddHandler)(update)
+					case "proxydel":
+						err = app.AdminAuthMiddleware(app.ProxyDeleteHandler)(update)
+					case "proxyrules":
+						err = app.AdminAuthMiddleware(app.ProxyRuleListHandler)(update)
+					case "proxyrule":
+						err = app.AdminAuthMiddleware(app.ProxyRuleAddHandler)(update)
+					case "proxyruledel":
+						err = app.AdminAuthMiddleware(app.ProxyRuleDeleteHandler)(update)
+					case "hosts":
+						err = app.AdminAuthMiddleware(app.HostRuleListHandler)(update)
+					case "hostallow":
+						err = app.AdminAuthMiddleware(app.HostAllowHandler)(update)
+					case "hostdeny":
+						err = app.AdminAuthMiddleware(app.HostDenyHandler)(update)
+					case "hostdel":
+						err = app.AdminAuthMiddleware(app.HostRuleDeleteHandler)(update)
+					case "sshadd":
+						conv.Start(sshAddHandler, update)
+					case "sshkeys":
+						err = app.AdminAuthMiddleware(app.SSHListHandler)(update)
+					case "sshdel":
+						err = app.AdminAuthMiddleware(app.SSHDeleteHandler)(update)
+					default:
 					}
 				} else {
 					if conv.HasConversation(update.ChatId(), update.UserId()) {
@@ -120,9 +210,13 @@ func main() {
 		}
 	}()
 
-	<-appCtx.Done()
+	<-shutdownDone
 }
 
+// Only text messages and documents of private chats are handled.
 func updateIsValid(update telbot.Update) bool {
-	return update.Message != nil && update.Message.Text != "" && update.ChatType() == telbot.ChatTypePrivate
+	if update.Message == nil || update.ChatType() != telbot.ChatTypePrivate {
+		return false
+	}
+	return update.Message.Text != "" || update.Message.Document != nil
 }
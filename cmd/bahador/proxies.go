@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/telbot"
+)
+
+// Proxy rules are kept in memory, because every request looks them up. They are
+// reloaded when admins change proxies or rules.
+type proxyRuleSet struct {
+	mu       sync.RWMutex
+	byDomain map[string]*url.URL
+}
+
+// Returns the proxy of the most specific rule that matches host or one of its
+// parent domains, or nil if no rule matches.
+func (rs *proxyRuleSet) forHost(host string) *url.URL {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	for _, domain := range db.DomainCandidates(host) {
+		if proxy, ok := rs.byDomain[domain]; ok {
+			return proxy
+		}
+	}
+	return nil
+}
+
+func (app *App) reloadProxyRules() error {
+	urls, err := app.DB.ProxyRuleUrls()
+	if err != nil {
+		return err
+	}
+	byDomain := map[string]*url.URL{}
+	for domain, rawUrl := range urls {
+		proxy, err := parseProxyUrl(rawUrl)
+		if err != nil {
+			app.Log.Printf("proxy rule of %s: %v", domain, err)
+			continue
+		}
+		byDomain[domain] = proxy
+	}
+	app.proxyRules.mu.Lock()
+	app.proxyRules.byDomain = byDomain
+	app.proxyRules.mu.Unlock()
+	return nil
+}
+
+// Returns the URL of the admin-defined proxy that a user selected for a job.
+func (app *App) jobProxy(name string) (*url.URL, error) {
+	p, err := app.DB.ProxyGet(name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrProxyNotFound
+		}
+		return nil, err
+	}
+	return parseProxyUrl(p.Url)
+}
+
+// Users only see proxy names, admins see their URLs too.
+func (app *App) ProxyListHandler(update telbot.Update) error {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil
+	}
+	proxies, err := app.DB.ProxyList()
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, p := range proxies {
+		line := p.Name
+		if u.IsAdmin {
+			if pu, err := url.Parse(p.Url); err == nil {
+				line += ": " + pu.Redacted()
+			}
+		}
+		lines = append(lines, line)
+	}
+	text := "No proxies defined."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /proxyadd <name> <url>
+func (app *App) ProxyAddHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 3 {
+		params.Text = "Usage: /proxyadd <name> <url>\nSupported schemes are http, https, socks5 and socks5h."
+	} else if _, err := parseProxyUrl(args[2]); err != nil {
+		params.Text = err.Error()
+	} else if err := app.DB.ProxyInsert(db.Proxy{Name: args[1], Url: args[2]}); err != nil {
+		return err
+	} else if err := app.reloadProxyRules(); err != nil {
+		return err
+	} else {
+		params.Text = fmt.Sprintf("Proxy %s saved.", args[1])
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+// Usage: /proxydel <name>
+func (app *App) ProxyDeleteHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 2 {
+		params.Text = "Usage: /proxydel <name>"
+	} else if ok, err := app.DB.ProxyDelete(args[1]); err != nil {
+		return err
+	} else if err := app.reloadProxyRules(); err != nil {
+		return err
+	} else if ok {
+		params.Text = fmt.Sprintf("Proxy %s and its rules deleted.", args[1])
+	} else {
+		params.Text = "Proxy does not exist."
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+func (app *App) ProxyRuleListHandler(update telbot.Update) error {
+	rules, err := app.DB.ProxyRuleList()
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, r := range rules {
+		lines = append(lines, fmt.Sprintf("%s -> %s", r.Domain, r.ProxyName))
+	}
+	text := "No proxy rules defined."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /proxyrule <domain> <proxy name>
+func (app *App) ProxyRuleAddHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 3 {
+		params.Text = "Usage: /proxyrule <domain> <proxy name>"
+	} else if _, err := app.DB.ProxyGet(args[2]); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		params.Text = "Proxy does not exist."
+	} else {
+		rule := db.ProxyRule{Domain: strings.ToLower(args[1]), ProxyName: args[2]}
+		if err := app.DB.ProxyRuleInsert(rule); err != nil {
+			return err
+		}
+		if err := app.reloadProxyRules(); err != nil {
+			return err
+		}
+		params.Text = fmt.Sprintf("Requests to %s will use proxy %s.", rule.Domain, rule.ProxyName)
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+// Usage: /proxyruledel <domain>
+func (app *App) ProxyRuleDeleteHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	if len(args) != 2 {
+		params.Text = "Usage: /proxyruledel <domain>"
+	} else if ok, err := app.DB.ProxyRuleDelete(strings.ToLower(args[1])); err != nil {
+		return err
+	} else if err := app.reloadProxyRules(); err != nil {
+		return err
+	} else if ok {
+		params.Text = fmt.Sprintf("Proxy rule for %s deleted.", args[1])
+	} else {
+		params.Text = "Proxy rule does not exist."
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const priorityUsersEnvVar string = "BAHADOR_PRIORITY_USERS"
+
+// Jobs of higher tiers get a bigger share of workers.
+type jobTier int
+
+const (
+	tierNormal jobTier = iota
+	tierPriority
+	tierAdmin
+)
+
+// Shares of workers that tiers get, relative to the normal tier. Small jobs get
+// `expressWeight` times the share of big jobs of their tier.
+var tierWeights = map[jobTier]float64{
+	tierNormal:   1,
+	tierPriority: 2,
+	tierAdmin:    4,
+}
+
+const (
+	// jobs that are not bigger than this are served in the express lane of their tier
+	expressJobSize int64 = filePartSize
+	expressWeight        = 2
+	// how long queueing a job waits for the size of its file
+	jobSizeTimeout = 30 * time.Second
+)
+
+type queuedJob struct {
+	job  dlJob
+	tier jobTier
+	// size of the file, or unknownFileSize
+	size    int64
+	express bool
+}
+
+// Jobs of a tier's lane, which share the workers by the weight of the class.
+type jobClass struct {
+	tier    jobTier
+	express bool
+}
+
+func (qj queuedJob) class() jobClass {
+	return jobClass{tier: qj.tier, express: qj.express}
+}
+
+func (c jobClass) weight() float64 {
+	if c.express {
+		return tierWeights[c.tier] * expressWeight
+	}
+	return tierWeights[c.tier]
+}
+
+// Served first when classes are equally behind their shares.
+func (c jobClass) before(other jobClass) bool {
+	if c.tier != other.tier {
+		return c.tier > other.tier
+	}
+	return c.express && !other.express
+}
+
+// A queue that shares workers fairly between users and classes of jobs. Classes
+// are served by weighted fair share: each served job moves its class forward by
+// the inverse of its weight, and the class that is the most behind is served
+// next, so jobs of lower tiers and big jobs get their share too. Users that
+// have jobs of the class are served round-robin.
+type jobQueue struct {
+	mu sync.Mutex
+	// users with queued jobs, in the order they are served
+	users []int
+	jobs  map[int][]queuedJob
+	// how far classes are served, and how far the last served class was.
+	// Classes that had no jobs continue from the last one.
+	passes map[jobClass]float64
+	vtime  float64
+	// wakes up a waiting worker
+	notify chan struct{}
+	// jobs that are being queued, which wait for their size before they are
+	// pushed. Closed queues refuse jobs, and drain waits for the pending ones
+	// and returns them.
+	closed  bool
+	pending int
+	refused []dlJob
+	pushed  *sync.Cond
+	// jobs that don't fit wait in the queue, and admit is called for the ones
+	// that are popped. Both are called with the queue locked.
+	fits  func(queuedJob) bool
+	admit func(queuedJob)
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{
+		jobs:   map[int][]queuedJob{},
+		passes: map[jobClass]float64{},
+		notify: make(chan struct{}, 1),
+	}
+	q.pushed = sync.NewCond(&q.mu)
+	return q
+}
+
+// Tells the queue that a job will be pushed. It returns false if the queue is closed.
+func (q *jobQueue) begin() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.pending++
+	return true
+}
+
+// Pushes a job that begin was called for. It returns false if the queue is
+// closed, and the job is returned by drain.
+func (q *jobQueue) push(qj queuedJob) bool {
+	q.mu.Lock()
+	q.pending--
+	if q.closed {
+		q.refused = append(q.refused, qj.job)
+		q.pushed.Broadcast()
+		q.mu.Unlock()
+		return false
+	}
+	userId := qj.job.userId
+	if len(q.jobs[userId]) == 0 {
+		q.users = append(q.users, userId)
+	}
+	q.jobs[userId] = append(q.jobs[userId], qj)
+	q.mu.Unlock()
+	q.wake()
+	return true
+}
+
+func (q *jobQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for a job. It returns false if ctx is done, without taking a job, so
+// stopped workers leave the jobs to the others.
+func (q *jobQueue) pop(ctx context.Context) (dlJob, bool) {
+	for {
+		if ctx.Err() != nil {
+			return dlJob{}, false
+		}
+		if job, ok := q.tryPop(); ok {
+			return job, true
+		}
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return dlJob{}, false
+		}
+	}
+}
+
+func (q *jobQueue) tryPop() (dlJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.users) == 0 {
+		return dlJob{}, false
+	}
+
+	fits := map[*jobProgress]bool{}
+	var (
+		class    jobClass
+		pass     float64
+		hasClass bool
+	)
+	for _, userId := range q.users {
+		for _, qj := range q.jobs[userId] {
+			if fits[qj.job.progress] = q.fits == nil || q.fits(qj); !fits[qj.job.progress] {
+				continue
+			}
+			c := qj.class()
+			p := max(q.passes[c], q.vtime)
+			if !hasClass || p < pass || (p == pass && c.before(class)) {
+				class, pass, hasClass = c, p, true
+			}
+		}
+	}
+	if !hasClass {
+		return dlJob{}, false
+	}
+
+	for i, userId := range q.users {
+		jobs := q.jobs[userId]
+		for j, qj := range jobs {
+			if !fits[qj.job.progress] || qj.class() != class {
+				continue
+			}
+			q.vtime, q.passes[class] = pass, pass+1/class.weight()
+			jobs = append(jobs[:j:j], jobs[j+1:]...)
+			// the user is served again after the other users
+			q.users = append(q.users[:i:i], q.users[i+1:]...)
+			if len(jobs) > 0 {
+				q.jobs[userId] = jobs
+				q.users = append(q.users, userId)
+			} else {
+				delete(q.jobs, userId)
+			}
+			if len(q.users) > 0 {
+				// other workers may be waiting for the remaining jobs
+				q.wake()
+			}
+			if q.admit != nil {
+				q.admit(qj)
+			}
+			return qj.job, true
+		}
+	}
+	return dlJob{}, false
+}
+
+// Closes the queue, and removes all queued jobs and returns them with the jobs
+// that were being queued.
+func (q *jobQueue) drain() []dlJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for q.pending > 0 {
+		q.pushed.Wait()
+	}
+	jobs := q.refused
+	for _, userId := range q.users {
+		for _, qj := range q.jobs[userId] {
+			jobs = append(jobs, qj.job)
+		}
+	}
+	q.users, q.jobs, q.refused = nil, map[int][]queuedJob{}, nil
+	return jobs
+}
+
+// Queues the job in its user's tier. The size of the file is asked from the
+// source to find small jobs and reserve disk space, which is not an error if it
+// fails. It returns false if the bot is shutting down, and the job is
+// checkpointed by shutdown.
+func (app *App) enqueueJob(job dlJob) bool {
+	if !app.jobQueue.begin() {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(withJobProxy(context.Background(), job.proxy), jobSizeTimeout)
+	job.info = nil
+	if name, size, err := job.source.Info(ctx); err == nil {
+		// the worker uses it too, so the source is not asked again
+		job.info = &sourceInfo{name: name, size: size}
+	}
+	cancel()
+	qj := queuedJob{job: job, tier: app.jobTier(job.userId), size: unknownFileSize}
+	if job.info != nil {
+		qj.size = job.info.size
+		qj.express = qj.size != unknownFileSize && qj.size <= expressJobSize && !job.archive.required()
+	}
+	return app.jobQueue.push(qj)
+}
+
+func (app *App) jobTier(userId int) jobTier {
+	if u, err := app.DB.UserAuthenticate(userId); err == nil && u.IsAdmin {
+		return tierAdmin
+	}
+	if app.priorityUsers[userId] {
+		return tierPriority
+	}
+	return tierNormal
+}
+
+func loadPriorityUsers() (map[int]bool, error) {
+	users := map[int]bool{}
+	for field := range strings.SplitSeq(os.Getenv(priorityUsersEnvVar), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		userId, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", priorityUsersEnvVar, err)
+		}
+		users[userId] = true
+	}
+	return users, nil
+}
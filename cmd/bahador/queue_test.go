@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func pushTestJob(t *testing.T, q *jobQueue, userId int, tier jobTier, express bool, name string) {
+	t.Helper()
+	if !q.begin() || !q.push(queuedJob{job: dlJob{userId: userId, url: name}, tier: tier, express: express}) {
+		t.Fatalf("job %s is refused", name)
+	}
+}
+
+// Pops `n` jobs and returns their names.
+func popTestJobs(t *testing.T, q *jobQueue, n int) []string {
+	t.Helper()
+	names := []string{}
+	for range n {
+		job, ok := q.tryPop()
+		if !ok {
+			t.Fatalf("queue is empty after %d jobs", len(names))
+		}
+		names = append(names, job.url)
+	}
+	return names
+}
+
+func TestJobQueueTierWeights(t *testing.T) {
+	q := newJobQueue()
+	for range 8 {
+		pushTestJob(t, q, 1, tierNormal, false, "normal")
+		pushTestJob(t, q, 2, tierPriority, false, "priority")
+		pushTestJob(t, q, 3, tierAdmin, false, "admin")
+	}
+
+	// higher tiers are served first when classes are equally behind
+	got := popTestJobs(t, q, 7)
+	want := []string{"admin", "priority", "normal", "admin", "admin", "priority", "admin"}
+	if !slices.Equal(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+	// and every 7 jobs are shared 4:2:1
+	got = popTestJobs(t, q, 7)
+	for name, n := range map[string]int{"admin": 4, "priority": 2, "normal": 1} {
+		if c := countOf(got, name); c != n {
+			t.Errorf("%d %s jobs in %v, want %d", c, name, got, n)
+		}
+	}
+}
+
+func TestJobQueueExpressLane(t *testing.T) {
+	q := newJobQueue()
+	pushTestJob(t, q, 1, tierNormal, false, "big 1")
+	pushTestJob(t, q, 1, tierNormal, false, "big 2")
+	pushTestJob(t, q, 1, tierNormal, false, "big 3")
+	pushTestJob(t, q, 1, tierNormal, true, "small 1")
+	pushTestJob(t, q, 1, tierNormal, true, "small 2")
+	pushTestJob(t, q, 1, tierNormal, true, "small 3")
+	pushTestJob(t, q, 1, tierNormal, true, "small 4")
+
+	// small jobs skip ahead of the big ones that were queued before them,
+	// but big jobs still get a third of the workers
+	got := popTestJobs(t, q, 7)
+	want := []string{"small 1", "big 1", "small 2", "small 3", "big 2", "small 4", "big 3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+}
+
+func TestJobQueueUsersRoundRobin(t *testing.T) {
+	q := newJobQueue()
+	pushTestJob(t, q, 1, tierNormal, false, "user 1 a")
+	pushTestJob(t, q, 1, tierNormal, false, "user 1 b")
+	pushTestJob(t, q, 1, tierNormal, false, "user 1 c")
+	pushTestJob(t, q, 2, tierNormal, false, "user 2 a")
+	pushTestJob(t, q, 2, tierNormal, false, "user 2 b")
+
+	got := popTestJobs(t, q, 5)
+	want := []string{"user 1 a", "user 2 a", "user 1 b", "user 2 b", "user 1 c"}
+	if !slices.Equal(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+	if _, ok := q.tryPop(); ok {
+		t.Error("queue is not empty")
+	}
+}
+
+func TestJobQueueIdleClassCatchesUp(t *testing.T) {
+	q := newJobQueue()
+	for range 6 {
+		pushTestJob(t, q, 1, tierAdmin, false, "admin")
+	}
+	popTestJobs(t, q, 6)
+
+	// a class that had no jobs doesn't get the turns that it missed
+	pushTestJob(t, q, 1, tierAdmin, false, "admin")
+	pushTestJob(t, q, 1, tierAdmin, false, "admin")
+	pushTestJob(t, q, 2, tierNormal, false, "normal")
+	pushTestJob(t, q, 2, tierNormal, false, "normal")
+	got := popTestJobs(t, q, 3)
+	if c := countOf(got, "normal"); c != 1 {
+		t.Errorf("jobs = %v, want 1 normal job", got)
+	}
+}
+
+func countOf(names []string, name string) int {
+	n := 0
+	for _, s := range names {
+		if s == name {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/telbot"
+)
+
+// Returns the finished job of a `/<command> <id>` message, or sends the reply
+// to the user and returns nil.
+func (app *App) finishedJobFromCommand(update telbot.Update, command string) (*db.FinishedJob, error) {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil, nil
+	}
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	var id int64
+	if len(args) == 2 {
+		id, err = strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+	}
+	if len(args) != 2 || err != nil {
+		params.Text = fmt.Sprintf("Usage: /%s <job>", command)
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return nil, err
+	}
+
+	j, err := app.DB.FinishedJobGet(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && j.UserId != u.UserId && !u.IsAdmin) {
+		params.Text = "Job does not exist."
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return nil, err
+	}
+	return j, err
+}
+
+// Deletes the signed links of the files, so the file server rejects them.
+func (app *App) revokeLinks(fileIds []string) error {
+	for _, fileId := range fileIds {
+		if _, err := app.DB.LinksDeleteByFile(fileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage: /revoke <job>
+// Links of the job stop working, but its files are kept.
+func (app *App) RevokeHandler(update telbot.Update) error {
+	j, err := app.finishedJobFromCommand(update, "revoke")
+	if j == nil {
+		return err
+	}
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	if app.files == nil {
+		params.Text = "Links of the storage can't be revoked. Use /delete to delete the files."
+	} else if err := app.revokeLinks(j.FileIds); err != nil {
+		return err
+	} else {
+		params.Text = fmt.Sprintf("Links of job #%d are revoked.", j.Id)
+	}
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+// Usage: /delete <job>
+// Deletes the files of the job from the storage, which also makes their links
+// stop working, and removes its downloaded file from the cache. The job is kept
+// if some files can't be deleted, so the command can be retried.
+func (app *App) DeleteHandler(update telbot.Update) error {
+	j, err := app.finishedJobFromCommand(update, "delete")
+	if j == nil {
+		return err
+	}
+	if err := app.revokeLinks(j.FileIds); err != nil {
+		return err
+	}
+	if j.CacheKey != "" && app.cache != nil {
+		app.cache.remove(j.CacheKey)
+	}
+
+	failed := 0
+	for _, fileId := range j.FileIds {
+		if err := app.storage.Delete(context.Background(), fileId); err != nil {
+			app.Log.Println(err)
+			failed++
+		}
+	}
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	if failed > 0 {
+		params.Text = fmt.Sprintf("%d of %d files of job #%d could not be deleted. Try again later.", failed, len(j.FileIds), j.Id)
+	} else {
+		if _, err := app.DB.FinishedJobDelete(j.Id); err != nil {
+			return err
+		}
+		params.Text = fmt.Sprintf("Files of job #%d are deleted.", j.Id)
+	}
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
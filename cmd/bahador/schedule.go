@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/telbot"
+	conv "github.com/thehxdev/telbot/ext/conversation"
+)
+
+const (
+	// how often the scheduler looks for due jobs
+	schedulerInterval  = 30 * time.Second
+	scheduleTimeFormat = "2006-01-02 15:04"
+)
+
+// Parses the start time of a job in server's local time. `at` takes a time of day,
+// which is the next occurrence of it, or a date and time. `in` takes a duration
+// like "2h30m".
+func parseStartTime(kind, value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case "at":
+		if t, err := time.ParseInLocation("15:04", value, time.Local); err == nil {
+			start := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+			if !start.After(now) {
+				start = start.AddDate(0, 0, 1)
+			}
+			return start, nil
+		}
+		if t, err := time.ParseInLocation(scheduleTimeFormat, value, time.Local); err == nil && t.After(now) {
+			return t, nil
+		}
+	case "in":
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return now.Add(d), nil
+		}
+	}
+	return time.Time{}, ErrInvalidStartTime
+}
+
+// Parses the optional `at <time>` or `in <duration>` arguments of upload commands.
+// Users get a reply if the arguments are invalid.
+func (app *App) startTimeFromCommand(update telbot.Update) (time.Time, bool) {
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 2 {
+		return time.Time{}, true
+	}
+	startAt, err := parseStartTime(args[1], strings.Join(args[2:], " "), time.Now())
+	if err != nil {
+		app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+			ChatId:           update.ChatId(),
+			Text:             err.Error(),
+			ReplyToMessageId: update.MessageId(),
+		})
+		return time.Time{}, false
+	}
+	return startAt, true
+}
+
+// Stores the job to be started by the scheduler. `answer` is the answer to the
+// question of the job's source, which is not asked again.
+func (app *App) scheduleJob(update telbot.Update, job dlJob, answer string) error {
+	params := telbot.TextMessageParams{
+		ChatId:           update.ChatId(),
+		ReplyToMessageId: update.MessageId(),
+	}
+	// links messages may contain secret headers
+	if len(app.secretKey) == 0 {
+		params.Text = secretEnvVar + " is not set. Can't schedule jobs."
+		app.Bot.SendMessage(context.Background(), params)
+		return &conv.EndConversation{}
+	}
+	encrypted, err := utils.Encrypt(app.secretKey, []byte(removeStartTimeOptions(job.message)))
+	if err != nil {
+		return err
+	}
+	id, err := app.DB.ScheduledJobInsert(db.ScheduledJob{
+		UserId:    job.userId,
+		ChatId:    update.ChatId(),
+		MessageId: update.MessageId(),
+		RunAt:     job.startAt.Unix(),
+		Message:   encrypted,
+		Answer:    answer,
+	})
+	if err != nil {
+		return err
+	}
+
+	params.Text = fmt.Sprintf("Job #%d is scheduled for %s.", id, job.startAt.Format(scheduleTimeFormat+" MST"))
+	app.Bot.SendMessage(context.Background(), params)
+	return &conv.EndConversation{}
+}
+
+// The links message is parsed again when the job is due, and the start time must
+// not schedule it again.
+func removeStartTimeOptions(text string) string {
+	lines := []string{}
+	for i, line := range strings.Split(text, "\n") {
+		key, _, ok := strings.Cut(line, "=")
+		if key = strings.TrimSpace(key); i > 0 && ok && (key == "at" || key == "in") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Starts scheduled jobs when they are due. Jobs that were due while the bot was
+// not running are started immediately.
+func (app *App) scheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for {
+		jobs, err := app.DB.ScheduledJobsDue(time.Now().Unix())
+		if err != nil {
+			app.Log.Println(err)
+		}
+		for _, sj := range jobs {
+			// jobs are removed before they start, so they never run twice
+			if ok, err := app.DB.ScheduledJobDelete(sj.Id); err != nil || !ok {
+				if err != nil {
+					app.Log.Println(err)
+				}
+				continue
+			}
+			go app.runScheduledJob(ctx, sj)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) runScheduledJob(ctx context.Context, sj db.ScheduledJob) {
+	params := telbot.TextMessageParams{
+		ChatId:           sj.ChatId,
+		ReplyToMessageId: sj.MessageId,
+	}
+	// jobs that were checkpointed by a shutdown continue from their progress
+	progress := app.takeJobCheckpoint(sj.Id)
+	drop := func() {
+		if progress != nil {
+			progress.remove()
+		}
+	}
+	// users may be removed after scheduling a job
+	if _, err := app.DB.UserAuthenticate(sj.UserId); err != nil {
+		app.Log.Printf("scheduled job #%d dropped: %v\n", sj.Id, err)
+		drop()
+		return
+	}
+
+	// errors of links messages are shown like when the job was created
+	job, errText := func() (dlJob, string) {
+		message, err := utils.Decrypt(app.secretKey, sj.Message)
+		if err != nil {
+			app.Log.Println(err)
+			return dlJob{}, userErrorText(err)
+		}
+		job, err := app.newLinkJob(sj.UserId, string(message))
+		if err != nil {
+			return dlJob{}, err.Error()
+		}
+		if chooser, ok := job.source.(Chooser); ok {
+			if _, err := chooser.Question(withJobProxy(ctx, job.proxy)); err != nil {
+				app.Log.Println(err)
+				return dlJob{}, userErrorText(err)
+			}
+			if sj.Answer != "" {
+				if err := chooser.Choose(sj.Answer); err != nil {
+					return dlJob{}, err.Error()
+				}
+			}
+		}
+		return job, ""
+	}()
+	if errText != "" {
+		params.Text = fmt.Sprintf("Scheduled job #%d failed: %s", sj.Id, errText)
+		app.Bot.SendMessage(context.Background(), params)
+		drop()
+		return
+	}
+
+	job.answer, job.progress = sj.Answer, progress
+	app.runJob(sj.ChatId, sj.MessageId, job)
+}
+
+// Lists scheduled jobs of the user, or all of them for admins.
+func (app *App) ScheduledListHandler(update telbot.Update) error {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil
+	}
+	var jobs []db.ScheduledJob
+	if u.IsAdmin {
+		jobs, err = app.DB.ScheduledJobList()
+	} else {
+		jobs, err = app.DB.ScheduledJobsByUser(u.UserId)
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	for _, sj := range jobs {
+		link := "(can't decrypt)"
+		if message, err := utils.Decrypt(app.secretKey, sj.Message); err == nil {
+			link, _, _ = strings.Cut(string(message), "\n")
+		}
+		line := fmt.Sprintf("#%d %s %s", sj.Id, time.Unix(sj.RunAt, 0).Format(scheduleTimeFormat), link)
+		if u.IsAdmin && sj.UserId != u.UserId {
+			line += fmt.Sprintf(" (user %d)", sj.UserId)
+		}
+		lines = append(lines, line)
+	}
+	text := "No scheduled jobs."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /unschedule <id>
+func (app *App) UnscheduleHandler(update telbot.Update) error {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil
+	}
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	var id int64
+	if len(args) == 2 {
+		id, err = strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+	}
+	if len(args) != 2 || err != nil {
+		params.Text = "Usage: /unschedule <id>"
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	sj, err := app.DB.ScheduledJobGet(id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && sj.UserId != u.UserId && !u.IsAdmin):
+		params.Text = "Scheduled job does not exist."
+	case err != nil:
+		return err
+	default:
+		ok, err := app.DB.ScheduledJobDelete(id)
+		if err != nil {
+			return err
+		}
+		params.Text = fmt.Sprintf("Scheduled job #%d canceled.", id)
+		if !ok {
+			// the scheduler took it first
+			params.Text = "Scheduled job has already started."
+		} else {
+			app.dropJobCheckpoint(id)
+		}
+	}
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
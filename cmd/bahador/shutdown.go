@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/telbot"
+)
+
+const (
+	shutdownGraceEnvVar  string = "BAHADOR_SHUTDOWN_GRACE"
+	defaultShutdownGrace        = time.Minute
+	// how long paused jobs have to stop after the grace period
+	shutdownPauseTimeout = 30 * time.Second
+	// how long finished jobs have to save and send their links after workers stop
+	shutdownResultsTimeout = 30 * time.Second
+
+	shutdownText = "Bot is shutting down. Try again later."
+)
+
+func loadShutdownGrace() (time.Duration, error) {
+	v := os.Getenv(shutdownGraceEnvVar)
+	if v == "" {
+		return defaultShutdownGrace, nil
+	}
+	grace, err := time.ParseDuration(v)
+	if err != nil || grace < 0 {
+		return 0, fmt.Errorf("invalid %s: must be a duration (e.g. 2m)", shutdownGraceEnvVar)
+	}
+	return grace, nil
+}
+
+// Stops accepting new jobs and waits `grace` for running jobs to finish. Jobs
+// that are still running after that are paused, and the unfinished jobs are
+// checkpointed to continue after restart. Database must stay open until it
+// returns.
+func (app *App) Shutdown(grace time.Duration) {
+	// runJob checks it with jobMu held, so jobWg is not added to after this
+	app.jobMu.Lock()
+	app.closing.Store(true)
+	app.jobMu.Unlock()
+	// workers finish their current job and stop
+	app.setWorkersCount(0)
+	// jobs that are being queued are waited for, at most for jobSizeTimeout
+	queued := app.jobQueue.drain()
+
+	if !waitGroupTimeout(&app.workerWg, grace) {
+		app.Log.Println("grace period is over, pausing running jobs")
+		app.pauseAllJobs()
+		if !waitGroupTimeout(&app.workerWg, shutdownPauseTimeout) {
+			app.Log.Println("some jobs did not stop")
+		}
+	}
+	app.checkpointJobs(queued)
+}
+
+// Waits for runJob calls that still save and send the results of their jobs.
+// Paused jobs return when the workers' context is done.
+func (app *App) waitJobResults() {
+	if !waitGroupTimeout(&app.jobWg, shutdownResultsTimeout) {
+		app.Log.Println("some jobs did not send their results")
+	}
+}
+
+func waitGroupTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (app *App) pauseAllJobs() {
+	app.jobMu.Lock()
+	defer app.jobMu.Unlock()
+	for _, e := range app.jobMap {
+		if e.state == jobRunning {
+			e.state = jobPausing
+			close(e.pauseChan)
+		}
+	}
+}
+
+// Checkpoints paused and queued jobs and tells their users. Jobs that did not stop
+// are dropped, because their progress is still in use.
+func (app *App) checkpointJobs(queued []dlJob) {
+	isQueued := map[int64]bool{}
+	for _, job := range queued {
+		isQueued[job.id] = true
+	}
+
+	stopped, interrupted := []*jobEntry{}, []*jobEntry{}
+	app.jobMu.Lock()
+	for jobId, e := range app.jobMap {
+		switch {
+		case e.state == jobPaused || isQueued[jobId]:
+			stopped = append(stopped, e)
+		case e.state == jobRunning || e.state == jobPausing:
+			interrupted = append(interrupted, e)
+		}
+	}
+	app.jobMu.Unlock()
+
+	for _, e := range stopped {
+		text := "Bot is restarting. The job will continue after restart."
+		if ok, err := app.checkpointJob(e); err != nil || !ok {
+			if err != nil {
+				app.Log.Println(err)
+			}
+			e.job.progress.remove()
+			text = "Bot is restarting. Send the job again after restart."
+		}
+		app.editJobStatus(e.chatId, e.msgId, text, nil)
+	}
+	for _, e := range interrupted {
+		app.editJobStatus(e.chatId, e.msgId, "Bot is restarting. The job is interrupted, send it again after restart.", nil)
+	}
+}
+
+// Stores the job as a scheduled job that is due immediately, with its progress.
+// Jobs are created again from their links message, so jobs of documents and
+// bots without a secret key can't be checkpointed.
+func (app *App) checkpointJob(e *jobEntry) (bool, error) {
+	if e.job.message == "" || len(app.secretKey) == 0 {
+		return false, nil
+	}
+	encrypted, err := utils.Encrypt(app.secretKey, []byte(removeStartTimeOptions(e.job.message)))
+	if err != nil {
+		return false, err
+	}
+	progress, err := json.Marshal(e.job.progress)
+	if err != nil {
+		return false, err
+	}
+	id, err := app.DB.ScheduledJobInsert(db.ScheduledJob{
+		UserId:    e.job.userId,
+		ChatId:    e.chatId,
+		MessageId: e.replyTo,
+		RunAt:     time.Now().Unix(),
+		Message:   encrypted,
+		Answer:    e.job.answer,
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := app.DB.JobCheckpointInsert(id, string(progress)); err != nil {
+		app.DB.ScheduledJobDelete(id)
+		return false, err
+	}
+	return true, nil
+}
+
+// Removes the checkpoint of a scheduled job and returns its progress. It returns
+// nil if the job has no checkpoint or its files are gone.
+func (app *App) takeJobCheckpoint(jobId int64) *jobProgress {
+	data, err := app.DB.JobCheckpointGet(jobId)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.Log.Println(err)
+		}
+		return nil
+	}
+	if _, err := app.DB.JobCheckpointDelete(jobId); err != nil {
+		app.Log.Println(err)
+	}
+
+	progress := newJobProgress()
+	if err := json.Unmarshal([]byte(data), progress); err != nil {
+		app.Log.Println(err)
+		return nil
+	}
+	if progress.tmpDir != "" {
+		if _, err := os.Stat(progress.tmpDir); err != nil {
+			app.Log.Printf("checkpoint of job #%d dropped: %v\n", jobId, err)
+			return nil
+		}
+	}
+	return progress
+}
+
+// Removes the checkpoint of a scheduled job that won't run, with its files.
+func (app *App) dropJobCheckpoint(jobId int64) {
+	if progress := app.takeJobCheckpoint(jobId); progress != nil {
+		progress.remove()
+	}
+}
+
+// Replies to users while the bot is shutting down.
+func (app *App) ShutdownHandler(update telbot.Update) error {
+	if _, err := app.DB.UserAuthenticate(update.UserId()); err != nil {
+		return nil
+	}
+	_, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId:           update.ChatId(),
+		Text:             shutdownText,
+		ReplyToMessageId: update.MessageId(),
+	})
+	return err
+}
+
+type extractedFileJSON struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Checkpointed form of `jobProgress`. Nil lists stay nil, because they mean the
+// step is not done yet.
+type jobProgressJSON struct {
+	TmpDir       string              `json:"tmp_dir"`
+	FilePath     string              `json:"file_path"`
+	FileSize     int64               `json:"file_size"`
+	Downloaded   bool                `json:"downloaded"`
+	Validator    string              `json:"validator"`
+	Parts        map[string][]string `json:"parts"`
+	Uploaded     map[string]string   `json:"uploaded"`
+	Extracted    []extractedFileJSON `json:"extracted"`
+	Entries      []extractedFileJSON `json:"entries"`
+	EntryFileIds [][]string          `json:"entry_file_ids"`
+}
+
+func (p *jobProgress) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jobProgressJSON{
+		TmpDir:       p.tmpDir,
+		FilePath:     p.filePath,
+		FileSize:     p.fileSize,
+		Downloaded:   p.downloaded,
+		Validator:    p.validator,
+		Parts:        p.parts,
+		Uploaded:     p.uploaded,
+		Extracted:    extractedFilesToJSON(p.extracted),
+		Entries:      extractedFilesToJSON(p.entries),
+		EntryFileIds: p.entryFileIds,
+	})
+}
+
+func (p *jobProgress) UnmarshalJSON(data []byte) error {
+	v := jobProgressJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = *newJobProgress()
+	p.tmpDir, p.filePath, p.fileSize, p.downloaded = v.TmpDir, v.FilePath, v.FileSize, v.Downloaded
+	p.validator = v.Validator
+	if v.Parts != nil {
+		p.parts = v.Parts
+	}
+	if v.Uploaded != nil {
+		p.uploaded = v.Uploaded
+	}
+	p.extracted = extractedFilesFromJSON(v.Extracted)
+	p.entries = extractedFilesFromJSON(v.Entries)
+	p.entryFileIds = v.EntryFileIds
+	return nil
+}
+
+func extractedFilesToJSON(files []extractedFile) []extractedFileJSON {
+	if files == nil {
+		return nil
+	}
+	v := make([]extractedFileJSON, 0, len(files))
+	for _, f := range files {
+		v = append(v, extractedFileJSON{Path: f.path, Size: f.size})
+	}
+	return v
+}
+
+func extractedFilesFromJSON(v []extractedFileJSON) []extractedFile {
+	if v == nil {
+		return nil
+	}
+	files := make([]extractedFile, 0, len(v))
+	for _, f := range v {
+		files = append(files, extractedFile{path: f.Path, size: f.Size})
+	}
+	return files
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Source is where the file of a job comes from. Every source must implement
+// either `Opener` or `Fetcher` too.
+type Source interface {
+	// Returns name and size of the file. Size is `unknownFileSize` if
+	// it's not known before downloading the file.
+	Info(ctx context.Context) (fname string, fsize int64, err error)
+}
+
+// Name and size of a file, as returned by `Source.Info`.
+type sourceInfo struct {
+	name string
+	size int64
+}
+
+// Returns the info that the source gave when the job was queued, or asks the
+// source if it failed then.
+func (job *dlJob) sourceInfo(ctx context.Context) (string, int64, error) {
+	if job.info != nil {
+		return job.info.name, job.info.size, nil
+	}
+	return job.source.Info(ctx)
+}
+
+// Opener is a source that can be streamed.
+type Opener interface {
+	Source
+
+	// Opens the file for reading from `offset` and returns the final name
+	// of the file, which may differ from the name reported by `Info`.
+	Open(ctx context.Context, offset int64) (io.ReadCloser, string, error)
+}
+
+// Fetcher is a source that can't be streamed and downloads itself into a directory.
+type Fetcher interface {
+	Source
+
+	// Downloads into `dir` and returns the path of downloaded file or directory.
+	Fetch(ctx context.Context, dir string) (string, error)
+}
+
+// Chooser is a source that users must choose what to download from, before
+// the job starts.
+type Chooser interface {
+	// Returns the question that user must answer. An empty question means
+	// there is nothing to choose.
+	Question(ctx context.Context) (string, error)
+
+	// Applies the user's answer to the question.
+	Choose(answer string) error
+}
+
+// file lists longer than this are truncated (Telegram messages are limited to 4096 characters)
+const maxFileListLength int = 3500
+
+// Returns a question that asks users to select from a numbered list of files.
+// Answers are parsed with `parseSelection`.
+func fileListQuestion(name string, paths []string, sizes []int64) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s has %d files:\n", name, len(paths))
+	for i := range paths {
+		line := fmt.Sprintf("%d. %s (%s)\n", i+1, paths[i], humanize.IBytes(uint64(sizes[i])))
+		if b.Len()+len(line) > maxFileListLength {
+			fmt.Fprintf(b, "... and %d more files\n", len(paths)-i)
+			break
+		}
+		b.WriteString(line)
+	}
+	b.WriteString("\nReply with numbers of files to download (e.g. 1,3,5-7) or \"all\".")
+	return b.String()
+}
+
+// Parses selections like "1,3,5-7" into sorted unique 1-based indexes. "all"
+// selects every item and returns nil.
+func parseSelection(answer string, count int) ([]int, error) {
+	answer = strings.TrimSpace(answer)
+	if strings.EqualFold(answer, "all") {
+		return nil, nil
+	}
+	seen := map[int]bool{}
+	for item := range strings.SplitSeq(answer, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		low, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, ErrInvalidSelection
+		}
+		high := low
+		if isRange {
+			if high, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+				return nil, ErrInvalidSelection
+			}
+		}
+		if low < 1 || high > count || low > high {
+			return nil, ErrInvalidSelection
+		}
+		for i := low; i <= high; i++ {
+			seen[i] = true
+		}
+	}
+	selected := make([]int, 0, len(seen))
+	for i := range seen {
+		selected = append(selected, i)
+	}
+	sort.Ints(selected)
+	return selected, nil
+}
+
+type sourceFactory func(app *App, job *dlJob, u *url.URL) (Source, error)
+
+// Supported URL schemes of links that users send.
+var sourceFactories = map[string]sourceFactory{
+	"http":   newHTTPSource,
+	"https":  newHTTPSource,
+	"ftp":    newFTPSource,
+	"ftps":   newFTPSource,
+	"sftp":   newSFTPSource,
+	"magnet": newTorrentSource,
+}
+
+func (app *App) newSource(job *dlJob) (Source, error) {
+	u, err := url.Parse(job.url)
+	if err != nil {
+		return nil, ErrUnsupportedUrl
+	}
+	factory, ok := sourceFactories[u.Scheme]
+	// magnet links don't have a host
+	if !ok || (u.Host == "" && u.Scheme != "magnet") {
+		return nil, ErrUnsupportedUrl
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		switch {
+		case strings.EqualFold(path.Ext(u.Path), ".torrent"):
+			factory = newTorrentSource
+		case app.mediaEnabled && isMediaHost(u.Hostname()):
+			factory = newMediaSource
+		case app.mediaDetect:
+			// pages that yt-dlp doesn't support are downloaded like files
+			s, err := detectMediaSource(app, job, u)
+			if s != nil || err != nil {
+				return s, err
+			}
+		}
+	}
+	return factory(app, job, u)
+}
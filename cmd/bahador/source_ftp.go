@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+const (
+	ftpDefaultPort    string = "21"
+	ftpsImplicitPort  string = "990"
+	ftpAnonymousUser  string = "anonymous"
+	ftpConnectTimeout        = 30 * time.Second
+)
+
+// Downloads files from ftp:// and ftps:// links in passive mode. ftps links use
+// explicit TLS (AUTH TLS), except on port 990 which is implicit TLS.
+type ftpSource struct {
+	url    *url.URL
+	dialer net.Dialer
+}
+
+func newFTPSource(app *App, job *dlJob, u *url.URL) (Source, error) {
+	allowed, err := app.checkHost(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	s := &ftpSource{
+		url:    u,
+		dialer: net.Dialer{Timeout: ftpConnectTimeout},
+	}
+	// both control and data connections are dialed with this dialer, so the
+	// guard also covers addresses that server sends in PASV responses.
+	if !allowed {
+		s.dialer.Control = app.dialControl
+	}
+	return s, nil
+}
+
+func (s *ftpSource) connect(ctx context.Context) (*ftp.ServerConn, error) {
+	host, port := s.url.Hostname(), s.url.Port()
+	if port == "" {
+		port = ftpDefaultPort
+	}
+	opts := []ftp.DialOption{
+		ftp.DialWithContext(ctx),
+		ftp.DialWithDialer(s.dialer),
+	}
+	if s.url.Scheme == "ftps" {
+		tlsConfig := &tls.Config{ServerName: host}
+		if port == ftpsImplicitPort {
+			opts = append(opts, ftp.DialWithTLS(tlsConfig))
+		} else {
+			opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+		}
+	}
+
+	c, err := ftp.Dial(net.JoinHostPort(host, port), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	user, password := ftpAnonymousUser, ftpAnonymousUser
+	if s.url.User != nil {
+		user = s.url.User.Username()
+		password, _ = s.url.User.Password()
+	}
+	if err := c.Login(user, password); err != nil {
+		c.Quit()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *ftpSource) Info(ctx context.Context) (string, int64, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	defer c.Quit()
+	// servers without SIZE command support still can be downloaded
+	fsize, err := c.FileSize(s.url.Path)
+	if err != nil {
+		fsize = unknownFileSize
+	}
+	return sanitizeFileName(path.Base(s.url.Path)), fsize, nil
+}
+
+func (s *ftpSource) Open(ctx context.Context, offset int64) (io.ReadCloser, string, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	// RetrFrom sends REST command before RETR if offset is not zero
+	resp, err := c.RetrFrom(s.url.Path, uint64(offset))
+	if err != nil {
+		c.Quit()
+		return nil, "", err
+	}
+	r := &ftpReader{Response: resp, conn: c}
+	// reads on the data connection don't know about the context
+	context.AfterFunc(ctx, func() { r.Close() })
+	return r, sanitizeFileName(path.Base(s.url.Path)), nil
+}
+
+type ftpReader struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+	once sync.Once
+	err  error
+}
+
+func (r *ftpReader) Close() error {
+	r.once.Do(func() {
+		r.err = r.Response.Close()
+		r.conn.Quit()
+	})
+	return r.err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Starts an FTP server on 127.0.0.1 that serves `files` in passive mode, with
+// the commands that the client needs for SIZE, REST and RETR.
+func startFTPServer(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTPConn(conn, files)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFTPConn(conn net.Conn, files map[string][]byte) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, v ...any) {
+		fmt.Fprintf(conn, format+"\r\n", v...)
+	}
+	reply("220 ready")
+
+	var (
+		dataLn net.Listener
+		offset int64
+	)
+	defer func() {
+		if dataLn != nil {
+			dataLn.Close()
+		}
+	}()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n REST STREAM\r\n EPSV\r\n211 End")
+		case "TYPE", "OPTS":
+			reply("200 ok")
+		case "SIZE":
+			data, ok := files[arg]
+			if !ok {
+				reply("550 not found")
+				continue
+			}
+			reply("213 %d", len(data))
+		case "EPSV":
+			if dataLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", dataLn.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			data, ok := files[arg]
+			if !ok || dataLn == nil {
+				reply("550 not found")
+				continue
+			}
+			reply("150 opening data connection")
+			dataConn, err := dataLn.Accept()
+			if err != nil {
+				return
+			}
+			dataConn.Write(data[offset:])
+			dataConn.Close()
+			dataLn.Close()
+			dataLn, offset = nil, 0
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func newTestFTPSource(t *testing.T, addr, fpath string) *ftpSource {
+	t.Helper()
+	u, err := url.Parse("ftp://" + addr + fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ftpSource{url: u, dialer: net.Dialer{Timeout: ftpConnectTimeout}}
+}
+
+func TestFTPSourceInfo(t *testing.T) {
+	addr := startFTPServer(t, map[string][]byte{"/pub/file.bin": []byte("0123456789")})
+
+	name, size, err := newTestFTPSource(t, addr, "/pub/file.bin").Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "file.bin" || size != 10 {
+		t.Errorf("Info() = %q, %d, want %q, %d", name, size, "file.bin", 10)
+	}
+
+	// files are still downloadable when servers don't tell their size
+	_, size, err = newTestFTPSource(t, addr, "/pub/missing.bin").Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != unknownFileSize {
+		t.Errorf("Info() size = %d, want %d", size, unknownFileSize)
+	}
+}
+
+func TestFTPSourceOpen(t *testing.T) {
+	content := []byte("0123456789")
+	addr := startFTPServer(t, map[string][]byte{"/pub/file.bin": content})
+	s := newTestFTPSource(t, addr, "/pub/file.bin")
+
+	for _, offset := range []int64{0, 4} {
+		body, name, err := s.Open(context.Background(), offset)
+		if err != nil {
+			t.Fatalf("Open(%d): %v", offset, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("Open(%d): %v", offset, err)
+		}
+		if name != "file.bin" {
+			t.Errorf("Open(%d) name = %q, want %q", offset, name, "file.bin")
+		}
+		if string(data) != string(content[offset:]) {
+			t.Errorf("Open(%d) = %q, want %q", offset, data, content[offset:])
+		}
+	}
+}
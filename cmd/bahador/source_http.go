@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type httpSource struct {
+	app    *App
+	url    string
+	header http.Header
+
+	mu sync.Mutex
+	// info of the last Info call, which the cache uses to find the file
+	info remoteFileInfo
+}
+
+func newHTTPSource(app *App, job *dlJob, u *url.URL) (Source, error) {
+	return &httpSource{app: app, url: job.url, header: job.header}, nil
+}
+
+func (s *httpSource) Info(ctx context.Context) (string, int64, error) {
+	info, err := s.app.getRemoteFileInfo(ctx, s.url, s.header)
+	if err == nil {
+		s.mu.Lock()
+		s.info = info
+		s.mu.Unlock()
+	}
+	return info.name, info.size, err
+}
+
+func (s *httpSource) fileInfo() remoteFileInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+// Opens the file from `offset` with a Range request, which fails if the server
+// doesn't send the file from there. The file is not checked for changes.
+func (s *httpSource) Open(ctx context.Context, offset int64) (io.ReadCloser, string, error) {
+	body, fname, start, _, err := s.request(ctx, offset, "")
+	if err == nil && start != offset {
+		body.Close()
+		return nil, "", ErrNonZeroStatusCode
+	}
+	return body, fname, err
+}
+
+// Opens the file from `offset` if it still has the `validator` (ETag or
+// Last-Modified) of the partial file, and from the beginning otherwise. Returns
+// the offset that the body starts at and the validator of the file. Files without
+// a validator are downloaded again, since their partial files may belong to an
+// older version.
+func (s *httpSource) openFrom(ctx context.Context, offset int64, validator string) (io.ReadCloser, string, int64, string, error) {
+	if validator == "" {
+		offset = 0
+	}
+	body, fname, start, validator, err := s.request(ctx, offset, validator)
+	if errors.Is(err, ErrNonZeroStatusCode) && offset > 0 {
+		return s.openFrom(ctx, 0, "")
+	}
+	return body, fname, start, validator, err
+}
+
+// Sends a GET request for the file from `offset`, and only if the file has
+// `ifRange` as its validator when it's not empty. Servers send the whole file
+// if they ignore the range or the file is changed, and the returned offset is
+// zero then.
+func (s *httpSource) request(ctx context.Context, offset int64, ifRange string) (io.ReadCloser, string, int64, string, error) {
+	req, err := newRequest(ctx, "GET", s.url, s.header)
+	if err != nil {
+		return nil, "", 0, "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	resp, err := s.app.httpClient.Do(req)
+	if err != nil {
+		return nil, "", 0, "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp.Header.Get("Content-Range")) == offset:
+	default:
+		resp.Body.Close()
+		return nil, "", 0, "", ErrNonZeroStatusCode
+	}
+	return resp.Body, resolveFileName(resp), offset, resumeValidator(resp.Header), nil
+}
+
+// Returns the first byte of a "bytes <first>-<last>/<size>" header, or -1.
+func contentRangeStart(header string) int64 {
+	first, _, ok := strings.Cut(strings.TrimPrefix(header, "bytes "), "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Weak ETags can't be used in If-Range headers, and Last-Modified is used instead.
+func resumeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mediaHostsEnvVar  string = "BAHADOR_MEDIA_HOSTS"
+	mediaDetectEnvVar string = "BAHADOR_MEDIA_DETECT"
+	mediaInfoTimeout         = 2 * time.Minute
+)
+
+// Links of these sites (and their subdomains) are downloaded with yt-dlp without
+// detection. The list can be replaced with BAHADOR_MEDIA_HOSTS environment
+// variable (comma separated).
+var defaultMediaHosts = []string{
+	"youtube.com",
+	"youtu.be",
+	"vimeo.com",
+	"dailymotion.com",
+	"twitch.tv",
+	"soundcloud.com",
+	"twitter.com",
+	"x.com",
+	"instagram.com",
+	"tiktok.com",
+	"reddit.com",
+	"facebook.com",
+}
+
+func mediaHosts() []string {
+	if v := os.Getenv(mediaHostsEnvVar); v != "" {
+		return strings.Split(v, ",")
+	}
+	return defaultMediaHosts
+}
+
+// Detection runs yt-dlp for every link, so it's only enabled if
+// BAHADOR_MEDIA_DETECT is true.
+func loadMediaDetect() (bool, error) {
+	v := os.Getenv(mediaDetectEnvVar)
+	if v == "" {
+		return false, nil
+	}
+	detect, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: must be true or false", mediaDetectEnvVar)
+	}
+	return detect, nil
+}
+
+func isMediaHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range mediaHosts() {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" && (host == h || strings.HasSuffix(host, "."+h)) {
+			return true
+		}
+	}
+	return false
+}
+
+type mediaChoice struct {
+	label string
+	// yt-dlp format selector
+	format string
+}
+
+// Extracts videos and audios from pages of media sites with yt-dlp.
+type mediaSource struct {
+	app    *App
+	url    *url.URL
+	header http.Header
+	// yt-dlp needs ffmpeg to merge separate video and audio streams
+	canMerge bool
+	// detected pages are only extracted by extractors of their sites
+	detected bool
+
+	title   string
+	choices []mediaChoice
+	format  string
+}
+
+func newMediaSource(app *App, job *dlJob, u *url.URL) (Source, error) {
+	if _, err := app.checkHost(u.Hostname()); err != nil {
+		return nil, err
+	}
+	_, err := exec.LookPath("ffmpeg")
+	s := &mediaSource{app: app, url: u, header: job.header, canMerge: err == nil}
+	s.format = s.bestFormat("")
+	return s, nil
+}
+
+// yt-dlp fails with this error if none of the extractors supports the link.
+var errNoMediaExtractor = errors.New("no suitable extractor")
+
+// Returns a media source if yt-dlp has an extractor for the page of the link,
+// or nil if it doesn't. The generic extractor is not used, because it takes
+// links of files and of any page with a video tag. The info that detection
+// loads is used for the format question.
+func detectMediaSource(app *App, job *dlJob, u *url.URL) (Source, error) {
+	src, err := newMediaSource(app, job, u)
+	if err != nil {
+		return nil, err
+	}
+	s := src.(*mediaSource)
+	s.detected = true
+	ctx, cancel := context.WithTimeout(withJobProxy(context.Background(), job.proxy), mediaInfoTimeout)
+	defer cancel()
+	if err := s.loadInfo(ctx); err != nil {
+		if errors.Is(err, errNoMediaExtractor) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the format selector of the best quality. `filter` (e.g. "[height<=720]")
+// limits the selected formats.
+func (s *mediaSource) bestFormat(filter string) string {
+	if s.canMerge {
+		return fmt.Sprintf("bv*%s+ba/b%s", filter, filter)
+	}
+	return "b" + filter
+}
+
+// Runs yt-dlp for the link. Its connections go through a guard proxy, which
+// also sends them through the proxy of the job.
+//
+// yt-dlp sends headers of --add-header to every host that it connects to, so
+// only cookies of the job are passed to it, in a cookies file that limits them
+// to the link's host. User-Agent and Referer are passed too, since they are not
+// secrets. Other headers (e.g. Authorization) are not used.
+func (s *mediaSource) run(ctx context.Context, args ...string) ([]byte, error) {
+	guard, err := s.app.startGuardProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer guard.close()
+	args = append(args, "--proxy", guard.url())
+
+	cookies, err := s.writeCookies()
+	if err != nil {
+		return nil, err
+	}
+	if cookies != "" {
+		defer os.Remove(cookies)
+		args = append(args, "--cookies", cookies)
+	}
+	if v := s.header.Get("User-Agent"); v != "" {
+		args = append(args, "--user-agent", v)
+	}
+	if v := s.header.Get("Referer"); v != "" {
+		args = append(args, "--referer", v)
+	}
+	if s.detected {
+		args = append(args, "--use-extractors", "default,-generic")
+	}
+	args = append(args, "--no-playlist", "--no-warnings", "--", s.url.String())
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "yt-dlp", args...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// programs that yt-dlp runs (e.g. ffmpeg) use the guard proxy too
+	cmd.Env = append(os.Environ(),
+		"http_proxy="+guard.url(), "https_proxy="+guard.url(), "all_proxy="+guard.url(),
+		"HTTP_PROXY="+guard.url(), "HTTPS_PROXY="+guard.url(), "ALL_PROXY="+guard.url(),
+		"no_proxy=", "NO_PROXY=")
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if strings.Contains(stderr.String(), "No suitable extractor") {
+			return nil, errNoMediaExtractor
+		}
+		return nil, fmt.Errorf("yt-dlp failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Writes cookies of the job to a file in Netscape format, for the link's host
+// only. Returns an empty path if the job has no cookies.
+func (s *mediaSource) writeCookies() (string, error) {
+	cookies := (&http.Request{Header: http.Header{"Cookie": s.header.Values("Cookie")}}).Cookies()
+	if len(cookies) == 0 {
+		return "", nil
+	}
+	f, err := os.CreateTemp("", "bahador-cookies-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := &strings.Builder{}
+	b.WriteString("# Netscape HTTP Cookie File\n")
+	for _, c := range cookies {
+		// host only, any path, not only secure connections, session cookie
+		fmt.Fprintf(b, "%s\tFALSE\t/\tFALSE\t0\t%s\t%s\n", s.url.Hostname(), c.Name, c.Value)
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+type ytdlpInfo struct {
+	Title   string `json:"title"`
+	Formats []struct {
+		Height int    `json:"height"`
+		VCodec string `json:"vcodec"`
+		ACodec string `json:"acodec"`
+	} `json:"formats"`
+}
+
+func (s *mediaSource) loadInfo(ctx context.Context) error {
+	if s.choices != nil {
+		return nil
+	}
+	cmdCtx, cmdCancel := context.WithTimeout(ctx, mediaInfoTimeout)
+	defer cmdCancel()
+	out, err := s.run(cmdCtx, "--dump-single-json", "--skip-download")
+	if err != nil {
+		return err
+	}
+	info := ytdlpInfo{}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return err
+	}
+
+	s.title = sanitizeFileName(info.Title)
+	heights := []int{}
+	hasAudio := false
+	for _, f := range info.Formats {
+		hasVideo := f.VCodec != "" && f.VCodec != "none"
+		if !hasVideo && f.ACodec != "" && f.ACodec != "none" {
+			hasAudio = true
+		}
+		// without ffmpeg only formats that have both video and audio can be downloaded
+		if hasVideo && f.Height > 0 && (s.canMerge || f.ACodec != "none") && !slices.Contains(heights, f.Height) {
+			heights = append(heights, f.Height)
+		}
+	}
+	slices.Sort(heights)
+	slices.Reverse(heights)
+
+	s.choices = []mediaChoice{{label: "Best quality", format: s.bestFormat("")}}
+	for _, h := range heights {
+		s.choices = append(s.choices, mediaChoice{
+			label:  fmt.Sprintf("Video %dp", h),
+			format: s.bestFormat(fmt.Sprintf("[height<=%d]", h)),
+		})
+	}
+	if hasAudio {
+		s.choices = append(s.choices, mediaChoice{label: "Audio only", format: "ba/b"})
+	}
+	return nil
+}
+
+// Size of extracted media is not known before downloading it.
+func (s *mediaSource) Info(ctx context.Context) (string, int64, error) {
+	if err := s.loadInfo(ctx); err != nil {
+		return "", 0, err
+	}
+	return s.title, unknownFileSize, nil
+}
+
+func (s *mediaSource) Question(ctx context.Context) (string, error) {
+	if err := s.loadInfo(ctx); err != nil {
+		return "", err
+	}
+	if len(s.choices) < 2 {
+		return "", nil
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s\nChoose a format:\n", s.title)
+	for i, c := range s.choices {
+		fmt.Fprintf(b, "%d. %s\n", i+1, c.label)
+	}
+	b.WriteString("\nReply with the number of a format.")
+	return b.String(), nil
+}
+
+func (s *mediaSource) Choose(answer string) error {
+	i, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || i < 1 || i > len(s.choices) {
+		return ErrInvalidSelection
+	}
+	s.format = s.choices[i-1].format
+	return nil
+}
+
+func (s *mediaSource) Fetch(ctx context.Context, dir string) (string, error) {
+	args := []string{
+		"--format", s.format,
+		"--max-filesize", strconv.FormatInt(maxFileSize, 10),
+		"--output", filepath.Join(dir, "%(title).150B [%(id)s].%(ext)s"),
+		"--print", "after_move:filepath",
+		"--no-simulate",
+		"--no-progress",
+		"--no-mtime",
+	}
+	if rate := s.app.bandwidth.processRate(false); rate > 0 {
+		args = append(args, "--limit-rate", strconv.FormatInt(rate, 10))
+	}
+	out, err := s.run(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	fpath := strings.TrimSpace(string(out))
+	if i := strings.LastIndexByte(fpath, '\n'); i >= 0 {
+		fpath = fpath[i+1:]
+	}
+	// yt-dlp skips files bigger than --max-filesize without an error
+	if fpath == "" {
+		return "", ErrMaxFileSize
+	}
+	if rel, err := filepath.Rel(dir, fpath); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("yt-dlp saved the file outside of %s: %s", dir, fpath)
+	}
+	return fpath, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/bahador/utils"
+	"github.com/thehxdev/telbot"
+	conv "github.com/thehxdev/telbot/ext/conversation"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshDefaultPort    string = "22"
+	sshConnectTimeout        = 30 * time.Second
+)
+
+// Downloads files from sftp://user@host[:port]/path links with credentials that
+// the user (an admin) stored with /sshadd.
+type sftpSource struct {
+	app      *App
+	url      *url.URL
+	userId   int
+	host     string
+	username string
+	hostKey  string
+	auth     ssh.AuthMethod
+	dialer   net.Dialer
+}
+
+func newSFTPSource(app *App, job *dlJob, u *url.URL) (Source, error) {
+	if u.User == nil || u.User.Username() == "" {
+		return nil, ErrNoSSHCredential
+	}
+	s := &sftpSource{
+		app:      app,
+		url:      u,
+		userId:   job.userId,
+		host:     sshHostPort(u.Host),
+		username: u.User.Username(),
+		dialer:   net.Dialer{Timeout: sshConnectTimeout},
+	}
+
+	cred, err := app.DB.SSHCredentialGet(s.userId, s.host, s.username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSSHCredential
+		}
+		return nil, err
+	}
+	secret, err := utils.Decrypt(app.secretKey, cred.Secret)
+	if err != nil {
+		return nil, err
+	}
+	s.hostKey = cred.HostKey
+	if s.auth, err = sshAuthMethod(secret); err != nil {
+		return nil, err
+	}
+
+	allowed, err := app.checkHost(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		s.dialer.Control = app.dialControl
+	}
+	return s, nil
+}
+
+func sshHostPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return strings.ToLower(host)
+	}
+	return net.JoinHostPort(strings.ToLower(strings.Trim(host, "[]")), sshDefaultPort)
+}
+
+// Secrets in PEM format are private keys and everything else is a password.
+func sshAuthMethod(secret []byte) (ssh.AuthMethod, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(secret)), "-----BEGIN") {
+		signer, err := ssh.ParsePrivateKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.PublicKeys(signer), nil
+	}
+	return ssh.Password(string(secret)), nil
+}
+
+// Host keys are trusted on first use and must match on later connections.
+func (s *sftpSource) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	got := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if s.hostKey == "" {
+		s.hostKey = got
+		return s.app.DB.SSHCredentialSetHostKey(s.userId, s.host, s.username, got)
+	}
+	if got != s.hostKey {
+		return ErrHostKeyMismatch
+	}
+	return nil
+}
+
+type sftpConn struct {
+	*sftp.Client
+	ssh *ssh.Client
+}
+
+func (c *sftpConn) Close() error {
+	err := c.Client.Close()
+	c.ssh.Close()
+	return err
+}
+
+func (s *sftpSource) connect(ctx context.Context) (*sftpConn, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.host)
+	if err != nil {
+		return nil, err
+	}
+	// ssh handshake does not know about the context
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	config := &ssh.ClientConfig{
+		User:            s.username,
+		Auth:            []ssh.AuthMethod{s.auth},
+		HostKeyCallback: s.checkHostKey,
+		Timeout:         sshConnectTimeout,
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.host, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+	sftpClient, err := sftp.NewClient(sshClient, sftp.UseConcurrentReads(true))
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpConn{Client: sftpClient, ssh: sshClient}, nil
+}
+
+func (s *sftpSource) Info(ctx context.Context) (string, int64, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	defer c.Close()
+	stat, err := c.Stat(s.url.Path)
+	if err != nil {
+		return "", 0, err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", 0, ErrNotRegularFile
+	}
+	return sanitizeFileName(path.Base(s.url.Path)), stat.Size(), nil
+}
+
+func (s *sftpSource) Open(ctx context.Context, offset int64) (io.ReadCloser, string, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := c.Open(s.url.Path)
+	if err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		c.Close()
+		return nil, "", err
+	}
+	r := &sftpReader{File: f, conn: c}
+	context.AfterFunc(ctx, func() { r.Close() })
+	return r, sanitizeFileName(path.Base(s.url.Path)), nil
+}
+
+type sftpReader struct {
+	*sftp.File
+	conn *sftpConn
+	once sync.Once
+	err  error
+}
+
+func (r *sftpReader) Close() error {
+	r.once.Do(func() {
+		r.err = r.File.Close()
+		r.conn.Close()
+	})
+	return r.err
+}
+
+// Parses user@host[:port] argument of SSH credential commands.
+func parseSSHTarget(arg string) (username, host string, ok bool) {
+	u, err := url.Parse("sftp://" + arg)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Hostname() == "" || u.Path != "" {
+		return "", "", false
+	}
+	return u.User.Username(), sshHostPort(u.Host), true
+}
+
+// Usage: /sshadd <user@host[:port]>
+// then the password or private key (PEM) in the next message.
+func (app *App) SSHAddCommandHandler(c *conv.Conversation, update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	var username, host string
+	ok := len(args) == 2
+	if ok {
+		username, host, ok = parseSSHTarget(args[1])
+	}
+	switch {
+	case !ok:
+		params.Text = "Usage: /sshadd <user@host[:port]>"
+	case len(app.secretKey) == 0:
+		params.Text = secretEnvVar + " is not set. Can't store credentials."
+	}
+	if params.Text != "" {
+		c.Next = endConversationHandler
+		_, err := app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	params.Text = fmt.Sprintf("Send the password or private key (PEM, without passphrase) of %s@%s.", username, host)
+	c.Next = func(c *conv.Conversation, update telbot.Update) error {
+		secret := []byte(strings.TrimSpace(update.Message.Text))
+		// don't keep secrets in chat history
+		if err := app.Bot.DeleteMessage(context.Background(), update.ChatId(), update.MessageId()); err != nil {
+			app.Log.Println(err)
+		}
+		params := telbot.TextMessageParams{ChatId: update.ChatId()}
+		if _, err := sshAuthMethod(secret); err != nil {
+			params.Text = "Invalid private key: " + err.Error()
+			app.Bot.SendMessage(context.Background(), params)
+			return &conv.EndConversation{}
+		}
+		encrypted, err := utils.Encrypt(app.secretKey, secret)
+		if err != nil {
+			return err
+		}
+		err = app.DB.SSHCredentialInsert(db.SSHCredential{
+			UserId:   update.UserId(),
+			Host:     host,
+			Username: username,
+			Secret:   encrypted,
+		})
+		if err != nil {
+			return err
+		}
+		params.Text = fmt.Sprintf("Credentials of %s@%s saved. Send sftp://%s@%s/path/to/file links with /up.", username, host, username, host)
+		app.Bot.SendMessage(context.Background(), params)
+		return &conv.EndConversation{}
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+func (app *App) SSHListHandler(update telbot.Update) error {
+	creds, err := app.DB.SSHCredentialList(update.UserId())
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, c := range creds {
+		line := fmt.Sprintf("%s@%s", c.Username, c.Host)
+		if c.HostKey == "" {
+			line += " (host key not saved yet)"
+		}
+		lines = append(lines, line)
+	}
+	text := "No SSH credentials."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /sshdel <user@host[:port]>
+func (app *App) SSHDeleteHandler(update telbot.Update) error {
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	var username, host string
+	ok := len(args) == 2
+	if ok {
+		username, host, ok = parseSSHTarget(args[1])
+	}
+	if !ok {
+		params.Text = "Usage: /sshdel <user@host[:port]>"
+	} else if deleted, err := app.DB.SSHCredentialDelete(update.UserId(), host, username); err != nil {
+		return err
+	} else if deleted {
+		params.Text = fmt.Sprintf("Credentials of %s@%s deleted.", username, host)
+	} else {
+		params.Text = "Credentials do not exist."
+	}
+	_, err := app.Bot.SendMessage(context.Background(), params)
+	return err
+}
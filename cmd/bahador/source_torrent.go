@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thehxdev/bahador/utils"
+)
+
+const (
+	torrentSeedTimeEnvVar  string = "BAHADOR_TORRENT_SEED_TIME"
+	torrentSeedRatioEnvVar string = "BAHADOR_TORRENT_SEED_RATIO"
+	// no seeding by default
+	defaultTorrentSeedTime  string = "0"
+	defaultTorrentSeedRatio string = "1.0"
+	maxTorrentFileSize      int64  = 10 * 1024 * 1024
+	torrentMetadataTimeout         = 2 * time.Minute
+)
+
+type torrentFile struct {
+	path string
+	size int64
+}
+
+// Downloads magnet links and .torrent files with aria2c. aria2c connects to
+// trackers by itself, so trackers on blocked addresses are removed from the
+// links and metadata, and web seeds are not used at all. Trackers are reached
+// through the job's proxy, which must be an http proxy. Peers are not covered,
+// since they only speak the BitTorrent protocol.
+type torrentSource struct {
+	app    *App
+	url    string
+	header http.Header
+
+	metadata []byte
+	name     string
+	files    []torrentFile
+	// 1-based indexes of selected files (aria2c's --select-file). Empty means all files.
+	selected []int
+}
+
+func newTorrentSource(app *App, job *dlJob, u *url.URL) (Source, error) {
+	if !app.torrentEnabled {
+		return nil, ErrTorrentUnavailable
+	}
+	return &torrentSource{app: app, url: job.url, header: job.header}, nil
+}
+
+func (s *torrentSource) loadMetadata(ctx context.Context) error {
+	if s.metadata != nil {
+		return nil
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasPrefix(s.url, "magnet:") {
+		data, err = s.fetchMagnetMetadata(ctx)
+	} else {
+		data, err = s.fetchTorrentFile(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = s.app.sanitizeTorrent(ctx, data); err != nil {
+		return err
+	}
+	name, files, err := parseTorrent(data)
+	if err != nil {
+		return err
+	}
+	s.metadata, s.name, s.files = data, name, files
+	return nil
+}
+
+func (s *torrentSource) fetchTorrentFile(ctx context.Context) ([]byte, error) {
+	req, err := newRequest(ctx, "GET", s.url, s.header)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.app.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrNonZeroStatusCode
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxTorrentFileSize {
+		return nil, ErrInvalidTorrent
+	}
+	return data, nil
+}
+
+// aria2c saves the metadata of magnet links as <info hash>.torrent
+func (s *torrentSource) fetchMagnetMetadata(ctx context.Context) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp(workDir, workDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cmdCtx, cmdCancel := context.WithTimeout(ctx, torrentMetadataTimeout)
+	defer cmdCancel()
+
+	proxyArgs, err := s.proxyArgs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{
+		"--bt-metadata-only=true",
+		"--bt-save-metadata=true",
+		"--dir=" + tmpDir,
+		"--quiet=true",
+	}, proxyArgs...)
+	args = append(args, s.app.filterMagnet(ctx, s.url))
+	if out, err := exec.CommandContext(cmdCtx, "aria2c", args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("aria2c failed to fetch metadata: %v: %s", err, out)
+	}
+	files, err := filepath.Glob(filepath.Join(tmpDir, "*.torrent"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrInvalidTorrent
+	}
+	return os.ReadFile(files[0])
+}
+
+// Removes the trackers of a magnet link that are on blocked addresses, and its
+// web seeds (ws, xs and as parameters).
+func (app *App) filterMagnet(ctx context.Context, magnet string) string {
+	prefix, query, _ := strings.Cut(magnet, "?")
+	params := []string{}
+	for param := range strings.SplitSeq(query, "&") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "ws", "xs", "as":
+			continue
+		case "tr":
+			tracker, err := url.QueryUnescape(value)
+			if err != nil || !app.trackerAllowed(ctx, tracker) {
+				continue
+			}
+		}
+		params = append(params, param)
+	}
+	return prefix + "?" + strings.Join(params, "&")
+}
+
+func (app *App) trackerAllowed(ctx context.Context, tracker string) bool {
+	u, err := url.Parse(tracker)
+	return err == nil && u.Hostname() != "" && !app.hostBlocked(ctx, u.Hostname())
+}
+
+// Rebuilds the torrent with its info dictionary and the trackers that are not
+// on blocked addresses. Other keys, like web seeds, are dropped. The info
+// dictionary is kept as is, so the info hash doesn't change.
+func (app *App) sanitizeTorrent(ctx context.Context, data []byte) ([]byte, error) {
+	dict, err := utils.BencodeRawDict(data)
+	if err != nil {
+		return nil, ErrInvalidTorrent
+	}
+	info, ok := dict["info"]
+	if !ok {
+		return nil, ErrInvalidTorrent
+	}
+
+	tiers := [][]string{}
+	if raw, ok := dict["announce-list"]; ok {
+		decoded, _ := utils.BencodeDecode(raw)
+		list, _ := decoded.([]any)
+		for _, item := range list {
+			tier := []string{}
+			trackers, _ := item.([]any)
+			for _, t := range trackers {
+				if tracker, ok := t.(string); ok {
+					tier = append(tier, tracker)
+				}
+			}
+			tiers = append(tiers, tier)
+		}
+	} else if raw, ok := dict["announce"]; ok {
+		// announce is only used by clients if there is no announce-list
+		if decoded, _ := utils.BencodeDecode(raw); decoded != nil {
+			if tracker, ok := decoded.(string); ok {
+				tiers = append(tiers, []string{tracker})
+			}
+		}
+	}
+
+	announceList := []any{}
+	for _, tier := range tiers {
+		allowed := []any{}
+		for _, tracker := range tier {
+			if app.trackerAllowed(ctx, tracker) {
+				allowed = append(allowed, tracker)
+			}
+		}
+		if len(allowed) > 0 {
+			announceList = append(announceList, allowed)
+		}
+	}
+	torrent := map[string]any{"info": utils.BencodeRaw(info)}
+	if len(announceList) > 0 {
+		torrent["announce-list"] = announceList
+	}
+	return utils.BencodeEncode(torrent)
+}
+
+// Returns the aria2c options of the proxy of the job, or of the global proxy.
+// aria2c only supports http proxies.
+func (s *torrentSource) proxyArgs(ctx context.Context) ([]string, error) {
+	proxy, ok := ctx.Value(jobProxyKey{}).(*url.URL)
+	if !ok {
+		proxy = s.app.globalProxy
+	}
+	if proxy == nil {
+		return nil, nil
+	}
+	if proxy.Scheme != "http" {
+		return nil, ErrTorrentProxy
+	}
+	return []string{"--all-proxy=" + proxy.String()}, nil
+}
+
+// Returns name and files of the torrent. Single file torrents have one file
+// with an empty path.
+func parseTorrent(data []byte) (string, []torrentFile, error) {
+	decoded, err := utils.BencodeDecode(data)
+	if err != nil {
+		return "", nil, err
+	}
+	root, _ := decoded.(map[string]any)
+	info, _ := root["info"].(map[string]any)
+	name, _ := info["name"].(string)
+	if name = sanitizeFileName(name); name == "" {
+		return "", nil, ErrInvalidTorrent
+	}
+	if length, ok := info["length"].(int64); ok {
+		return name, []torrentFile{{size: length}}, nil
+	}
+
+	list, _ := info["files"].([]any)
+	files := []torrentFile{}
+	for _, item := range list {
+		f, _ := item.(map[string]any)
+		length, ok := f["length"].(int64)
+		if !ok {
+			return "", nil, ErrInvalidTorrent
+		}
+		elems, _ := f["path"].([]any)
+		parts := []string{}
+		for _, e := range elems {
+			part, _ := e.(string)
+			if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+				return "", nil, ErrInvalidTorrent
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) == 0 {
+			return "", nil, ErrInvalidTorrent
+		}
+		files = append(files, torrentFile{path: path.Join(parts...), size: length})
+	}
+	if len(files) == 0 {
+		return "", nil, ErrInvalidTorrent
+	}
+	return name, files, nil
+}
+
+func (s *torrentSource) selectedFiles() []torrentFile {
+	if len(s.selected) == 0 {
+		return s.files
+	}
+	files := []torrentFile{}
+	for _, i := range s.selected {
+		files = append(files, s.files[i-1])
+	}
+	return files
+}
+
+func (s *torrentSource) Info(ctx context.Context) (string, int64, error) {
+	if err := s.loadMetadata(ctx); err != nil {
+		return "", 0, err
+	}
+	var size int64
+	for _, f := range s.selectedFiles() {
+		size += f.size
+	}
+	return s.name, size, nil
+}
+
+func (s *torrentSource) Question(ctx context.Context) (string, error) {
+	if err := s.loadMetadata(ctx); err != nil {
+		return "", err
+	}
+	if len(s.files) < 2 {
+		return "", nil
+	}
+	paths := make([]string, len(s.files))
+	sizes := make([]int64, len(s.files))
+	for i, f := range s.files {
+		paths[i], sizes[i] = f.path, f.size
+	}
+	return fileListQuestion(s.name, paths, sizes), nil
+}
+
+func (s *torrentSource) Choose(answer string) error {
+	selected, err := parseSelection(answer, len(s.files))
+	if err != nil {
+		return err
+	}
+	s.selected = selected
+	var size int64
+	for _, f := range s.selectedFiles() {
+		size += f.size
+	}
+	if size > maxFileSize {
+		return ErrMaxFileSize
+	}
+	return nil
+}
+
+func (s *torrentSource) Fetch(ctx context.Context, dir string) (string, error) {
+	if err := s.loadMetadata(ctx); err != nil {
+		return "", err
+	}
+	torrentPath := filepath.Join(dir, "metadata.torrent")
+	if err := os.WriteFile(torrentPath, s.metadata, 0o600); err != nil {
+		return "", err
+	}
+	outDir := filepath.Join(dir, "files")
+	proxyArgs, err := s.proxyArgs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{
+		"--dir=" + outDir,
+		"--seed-time=" + envOrDefault(torrentSeedTimeEnvVar, defaultTorrentSeedTime),
+		"--seed-ratio=" + envOrDefault(torrentSeedRatioEnvVar, defaultTorrentSeedRatio),
+		"--bt-remove-unselected-file=true",
+		// paused jobs continue from the downloaded pieces
+		"--continue=true",
+		"--file-allocation=none",
+		"--summary-interval=0",
+		"--console-log-level=warn",
+	}
+	if len(s.selected) > 0 {
+		indexes := []string{}
+		for _, i := range s.selected {
+			indexes = append(indexes, strconv.Itoa(i))
+		}
+		args = append(args, "--select-file="+strings.Join(indexes, ","))
+	}
+	// seeding uploads count as uploads
+	args = append(args,
+		"--max-overall-download-limit="+strconv.FormatInt(s.app.bandwidth.processRate(false), 10),
+		"--max-overall-upload-limit="+strconv.FormatInt(s.app.bandwidth.processRate(true), 10),
+	)
+	args = append(args, proxyArgs...)
+	args = append(args, "--torrent-file="+torrentPath)
+
+	if out, err := exec.CommandContext(ctx, "aria2c", args...).CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("aria2c failed: %v: %s", err, out)
+	}
+
+	// files of multi-file torrents are saved in a directory named after the
+	// torrent. aria2c names it with the original name, which is renamed to the
+	// sanitized one.
+	saved, err := torrentOutput(outDir)
+	if err != nil {
+		return "", err
+	}
+	result := filepath.Join(outDir, s.name)
+	if saved != result {
+		if err := os.Rename(saved, result); err != nil {
+			return "", err
+		}
+	}
+	if files := s.selectedFiles(); len(files) == 1 && files[0].path != "" {
+		result = filepath.Join(result, filepath.FromSlash(files[0].path))
+	}
+	if _, err := os.Stat(result); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// Returns the path of the file or directory that aria2c saved in `outDir`.
+func torrentOutput(outDir string) (string, error) {
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return "", err
+	}
+	saved := []string{}
+	for _, e := range entries {
+		// control files of unfinished downloads
+		if !strings.HasSuffix(e.Name(), ".aria2") {
+			saved = append(saved, filepath.Join(outDir, e.Name()))
+		}
+	}
+	if len(saved) != 1 {
+		return "", fmt.Errorf("aria2c saved %d files instead of one", len(saved))
+	}
+	return saved[0], nil
+}
+
+func envOrDefault(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/telbot"
+	"github.com/thehxdev/telbot/types"
+)
+
+const (
+	storageEnvVar string = "BAHADOR_STORAGE"
+	linkTTLEnvVar string = "BAHADOR_LINK_TTL"
+
+	defaultLinkTTL = 24 * time.Hour
+)
+
+// Where uploaded files are stored. Files are identified by the ids that Upload
+// returns, which end with "/<name>", and users get their links from Link.
+type Storage interface {
+	// Stores `size` bytes of `r` as a file named `name`.
+	Upload(ctx context.Context, name string, r io.Reader, size int64) (string, error)
+	Link(ctx context.Context, id string) (string, error)
+	// Removes the file, so its links stop working.
+	Delete(ctx context.Context, id string) error
+	// Files bigger than this are archived in parts. Zero means files are always
+	// uploaded whole.
+	MaxFileSize() int64
+}
+
+// Returns the http client of storages and of the file server, which streams
+// their files. Storages are configured by the admin and may be on a private
+// network, so the guarded client of users' links is not used.
+func newStorageClient() *http.Client {
+	return &http.Client{}
+}
+
+func loadLinkTTL() (time.Duration, error) {
+	v := os.Getenv(linkTTLEnvVar)
+	if v == "" {
+		return defaultLinkTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be a duration (e.g. 24h)", linkTTLEnvVar)
+	}
+	return ttl, nil
+}
+
+func (app *App) loadStorage() (Storage, error) {
+	ttl, err := loadLinkTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind := os.Getenv(storageEnvVar); kind {
+	case "", "telegram":
+		return &telegramStorage{app: app}, nil
+	case "s3":
+		return newS3Storage(ttl)
+	case "webdav":
+		return newWebDAVStorage()
+	case "local":
+		return newLocalStorage()
+	default:
+		return nil, fmt.Errorf("invalid %s: unknown storage %q", storageEnvVar, kind)
+	}
+}
+
+// Files are sent to the bot itself, and their links are the Bot API server's
+// links of them. Ids are the Telegram file ids followed by the ids of their
+// messages and the file names, so each upload is deleted by its own message.
+type telegramStorage struct {
+	app *App
+}
+
+func (s *telegramStorage) Upload(ctx context.Context, name string, r io.Reader, size int64) (string, error) {
+	uparams := telbot.UploadParams{
+		ChatId: s.app.Bot.Self.Id,
+		Method: "sendDocument",
+	}
+	files := []telbot.IFileInfo{
+		&telbot.FileReader{
+			Reader:   r,
+			FileName: name,
+			Kind:     "document",
+		},
+	}
+	msg, err := s.app.Bot.UploadFile(ctx, uparams, files)
+	if err != nil {
+		return "", err
+	}
+	userId, _ := ctx.Value(jobUserKey{}).(int)
+	if err := s.saveMessage(userId, name, msg); err != nil {
+		s.app.Log.Println(err)
+	}
+	return fmt.Sprintf("%s/%d/%s", msg.Document.FileId, msg.Id, name), nil
+}
+
+func (s *telegramStorage) saveMessage(userId int, name string, msg *types.Message) error {
+	err := s.app.DB.MessageInsert(db.Message{
+		MessageId: msg.Id,
+		Date:      uint(msg.Date),
+		UserId:    userId,
+		ChatId:    msg.Chat.Id,
+	})
+	if err != nil {
+		return err
+	}
+	return s.app.DB.FileInsert(db.File{
+		FileId:       msg.Document.FileId,
+		FileUniqueId: msg.Document.FileUniqueId,
+		FileName:     name,
+		FileSize:     msg.Document.FileSize,
+		MessageId:    msg.Id,
+		UserId:       userId,
+	})
+}
+
+func (s *telegramStorage) Link(ctx context.Context, id string) (string, error) {
+	fileId, _, _ := strings.Cut(id, "/")
+	return url.JoinPath(s.app.Bot.BaseFileUrl, fileId)
+}
+
+// Ids of files that were uploaded by older versions don't have their message,
+// and only their links can be revoked.
+func (s *telegramStorage) Delete(ctx context.Context, id string) error {
+	parts := strings.SplitN(id, "/", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("message of file %q is unknown", id)
+	}
+	messageId, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("message of file %q is unknown", id)
+	}
+	if err := s.app.Bot.DeleteMessage(ctx, s.app.Bot.Self.Id, messageId); err != nil {
+		return err
+	}
+	if _, err := s.app.DB.FileDeleteByMessage(messageId); err != nil {
+		return err
+	}
+	_, err = s.app.DB.MessageDelete(messageId)
+	return err
+}
+
+func (s *telegramStorage) MaxFileSize() int64 {
+	return filePartSize
+}
+
+// Returns a random directory name for a file, so files with the same name don't
+// replace each other and their links can't be guessed.
+func newStorageDir() string {
+	return strings.ToLower(rand.Text())
+}
+
+// Returns the name of the file of a storage id.
+func storageFileName(id string) string {
+	_, name, ok := strings.Cut(id, "/")
+	if !ok {
+		return "file"
+	}
+	return path.Base(name)
+}
+
+// Returns the random directory of the file of a storage id.
+func storageFileDir(id string) string {
+	dir, _, _ := strings.Cut(id, "/")
+	return dir
+}
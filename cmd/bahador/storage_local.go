@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/thehxdev/bahador/utils"
+)
+
+const (
+	localStorageDirEnvVar string = "BAHADOR_LOCAL_STORAGE_DIR"
+	// public url that the directory is served at
+	localStorageUrlEnvVar string = "BAHADOR_LOCAL_STORAGE_URL"
+)
+
+// Stores files in a directory that a web server serves.
+type localStorage struct {
+	dir     string
+	linkUrl *url.URL
+}
+
+func newLocalStorage() (*localStorage, error) {
+	dir := utils.GetNonEmptyEnv(localStorageDirEnvVar)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", localStorageDirEnvVar, err)
+	}
+	linkUrl, err := parseStorageUrl(localStorageUrlEnvVar, utils.GetNonEmptyEnv(localStorageUrlEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir, linkUrl: linkUrl}, nil
+}
+
+func (s *localStorage) Upload(ctx context.Context, name string, r io.Reader, size int64) (string, error) {
+	id := newStorageDir() + "/" + name
+	fpath := filepath.Join(s.dir, filepath.FromSlash(id))
+	if err := os.MkdirAll(filepath.Dir(fpath), 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	n, err := utils.CopyWithContext(ctx, f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size != unknownFileSize && n != size {
+		err = fmt.Errorf("%d of %d bytes are written", n, size)
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Dir(fpath))
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *localStorage) Link(ctx context.Context, id string) (string, error) {
+	return s.linkUrl.JoinPath(id).String(), nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, id string) error {
+	dir := storageFileDir(id)
+	if !filepath.IsLocal(dir) {
+		return fmt.Errorf("invalid file id %q", id)
+	}
+	return os.RemoveAll(filepath.Join(s.dir, dir))
+}
+
+func (s *localStorage) MaxFileSize() int64 {
+	return 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thehxdev/bahador/utils"
+)
+
+const (
+	s3EndpointEnvVar  string = "BAHADOR_S3_ENDPOINT"
+	s3RegionEnvVar    string = "BAHADOR_S3_REGION"
+	s3BucketEnvVar    string = "BAHADOR_S3_BUCKET"
+	s3AccessKeyEnvVar string = "BAHADOR_S3_ACCESS_KEY"
+	s3SecretKeyEnvVar string = "BAHADOR_S3_SECRET_KEY"
+
+	defaultS3Region = "us-east-1"
+	// longest expiration of presigned urls
+	maxS3LinkTTL = 7 * 24 * time.Hour
+
+	s3TimeFormat       = "20060102T150405Z"
+	s3DateFormat       = "20060102"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// Stores files in a bucket of an S3 compatible object storage, addressed with
+// path style urls. Requests are signed with AWS Signature Version 4, and links
+// are presigned urls that expire after the link TTL.
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	linkTTL   time.Duration
+	client    *http.Client
+}
+
+func newS3Storage(linkTTL time.Duration) (*s3Storage, error) {
+	endpoint, err := url.Parse(utils.GetNonEmptyEnv(s3EndpointEnvVar))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid %s: must be an http(s) url", s3EndpointEnvVar)
+	}
+	if linkTTL > maxS3LinkTTL {
+		return nil, fmt.Errorf("invalid %s: presigned links can't be valid for more than %s", linkTTLEnvVar, maxS3LinkTTL)
+	}
+	s := &s3Storage{
+		endpoint:  endpoint,
+		region:    defaultS3Region,
+		bucket:    utils.GetNonEmptyEnv(s3BucketEnvVar),
+		accessKey: utils.GetNonEmptyEnv(s3AccessKeyEnvVar),
+		secretKey: utils.GetNonEmptyEnv(s3SecretKeyEnvVar),
+		linkTTL:   linkTTL,
+		client:    newStorageClient(),
+	}
+	if region := strings.TrimSpace(os.Getenv(s3RegionEnvVar)); region != "" {
+		s.region = region
+	}
+	return s, nil
+}
+
+func (s *s3Storage) Upload(ctx context.Context, name string, r io.Reader, size int64) (string, error) {
+	key := newStorageDir() + "/" + name
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectUrl(key), io.NopCloser(r))
+	if err != nil {
+		return "", err
+	}
+	// S3 needs the length of objects that are uploaded with a single request
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	s.sign(req, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("s3 upload failed: %s: %s", resp.Status, body)
+	}
+	return key, nil
+}
+
+func (s *s3Storage) Link(ctx context.Context, key string) (string, error) {
+	return s.presign(key, time.Now()), nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectUrl(key), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 delete failed: %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+func (s *s3Storage) MaxFileSize() int64 {
+	return 0
+}
+
+func (s *s3Storage) objectUrl(key string) string {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	u.RawPath = "/" + s3EscapePath(s.bucket) + "/" + s3EscapePath(key)
+	return u.String()
+}
+
+// Signs the request with the Authorization header. The payload is not signed,
+// because it's streamed.
+func (s *s3Storage) sign(req *http.Request, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.UTC().Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           t.UTC().Format(s3TimeFormat),
+	}
+	signature := s.signature(req.Method, req.URL.EscapedPath(), url.Values{}, headers, signedHeaders, t)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgorithm, s.accessKey, s.scope(t), strings.Join(signedHeaders, ";"), signature))
+}
+
+// Returns a GET url of the object that is valid for the link TTL.
+func (s *s3Storage) presign(key string, t time.Time) string {
+	u, _ := url.Parse(s.objectUrl(key))
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3SigningAlgorithm},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(t)},
+		"X-Amz-Date":          {t.UTC().Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.FormatInt(int64(s.linkTTL/time.Second), 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	signature := s.signature(http.MethodGet, u.EscapedPath(), query, map[string]string{"host": u.Host}, []string{"host"}, t)
+	query.Set("X-Amz-Signature", signature)
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+func (s *s3Storage) scope(t time.Time) string {
+	return t.UTC().Format(s3DateFormat) + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *s3Storage) signature(method, path string, query url.Values, headers map[string]string, signedHeaders []string, t time.Time) string {
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		s3UnsignedPayload,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		t.UTC().Format(s3TimeFormat),
+		s.scope(t),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.UTC().Format(s3DateFormat))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Escapes every byte except the unreserved characters, as SigV4 requires.
+func s3Escape(s string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testS3Region    = "eu-west-1"
+	testS3Bucket    = "files"
+)
+
+// An object storage that keeps objects in memory and rejects requests that are
+// not signed with the test credentials. Signatures are computed from what the
+// server received, so they don't depend on how the client built them.
+type testS3Server struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func startS3Server(t *testing.T) (*httptest.Server, *testS3Server) {
+	t.Helper()
+	s := &testS3Server{t: t, objects: map[string][]byte{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv, s
+}
+
+func (s *testS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err string
+	if r.URL.Query().Has("X-Amz-Signature") {
+		err = s.checkPresigned(r)
+	} else {
+		err = s.checkAuthorization(r)
+	}
+	if err != "" {
+		s.t.Errorf("%s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, err, http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			http.Error(w, "body does not match Content-Length", http.StatusBadRequest)
+			return
+		}
+		s.objects[r.URL.Path] = data
+	case http.MethodGet:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *testS3Server) object(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[path]
+	return data, ok
+}
+
+func (s *testS3Server) checkAuthorization(r *http.Request) string {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != "UNSIGNED-PAYLOAD" && len(payloadHash) != sha256.Size*2 {
+		return "missing X-Amz-Content-Sha256"
+	}
+	params, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "Authorization is not AWS4-HMAC-SHA256"
+	}
+	fields := map[string]string{}
+	for field := range strings.SplitSeq(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[k] = v
+	}
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	for _, name := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+fields["SignedHeaders"]+";", ";"+name+";") {
+			return name + " is not signed"
+		}
+	}
+	headers := map[string]string{}
+	for _, name := range signedHeaders {
+		headers[name] = r.Header.Get(name)
+	}
+	headers["host"] = r.Host
+	return s.checkSignature(r, fields["Credential"], r.Header.Get("X-Amz-Date"), url.Values{},
+		headers, signedHeaders, payloadHash, fields["Signature"])
+}
+
+func (s *testS3Server) checkPresigned(r *http.Request) string {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+		return "X-Amz-Algorithm is not AWS4-HMAC-SHA256"
+	}
+	if query.Get("X-Amz-SignedHeaders") != "host" {
+		return "X-Amz-SignedHeaders is not host"
+	}
+	date, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	expires, err2 := time.ParseDuration(query.Get("X-Amz-Expires") + "s")
+	if err != nil || err2 != nil || time.Now().After(date.Add(expires)) {
+		return "link is expired"
+	}
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+	return s.checkSignature(r, query.Get("X-Amz-Credential"), query.Get("X-Amz-Date"), query,
+		map[string]string{"host": r.Host}, []string{"host"}, "UNSIGNED-PAYLOAD", signature)
+}
+
+func (s *testS3Server) checkSignature(r *http.Request, credential, amzDate string, query url.Values, headers map[string]string, signedHeaders []string, payloadHash, signature string) string {
+	date, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(date).Abs() > 15*time.Minute {
+		return "invalid X-Amz-Date"
+	}
+	scope := date.Format("20060102") + "/" + testS3Region + "/s3/aws4_request"
+	if credential != testS3AccessKey+"/"+scope {
+		return "invalid credential " + credential
+	}
+
+	// paths and queries are escaped except the unreserved characters, like S3 does
+	escape := func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, escape(k)+"="+escape(query.Get(k)))
+	}
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range signedHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	canonicalRequest := r.Method + "\n" + strings.Join(segments, "/") + "\n" + strings.Join(pairs, "&") + "\n" +
+		canonicalHeaders.String() + "\n" + strings.Join(signedHeaders, ";") + "\n" + payloadHash
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+testS3SecretKey), date.Format("20060102"))
+	key = mac(mac(mac(key, testS3Region), "s3"), "aws4_request")
+	if expected := hex.EncodeToString(mac(key, stringToSign)); signature != expected {
+		return "signature does not match"
+	}
+	return ""
+}
+
+func newTestS3Storage(t *testing.T, endpoint string) *s3Storage {
+	t.Helper()
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &s3Storage{
+		endpoint:  u,
+		region:    testS3Region,
+		bucket:    testS3Bucket,
+		accessKey: testS3AccessKey,
+		secretKey: testS3SecretKey,
+		linkTTL:   time.Hour,
+		client:    &http.Client{},
+	}
+}
+
+func TestS3StorageUploadAndDelete(t *testing.T) {
+	srv, server := startS3Server(t)
+	s := newTestS3Storage(t, srv.URL)
+	content := []byte("file content")
+
+	// names are escaped in the path that is signed
+	key, err := s.Upload(context.Background(), "my file (1)+ü.txt", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(key, "/my file (1)+ü.txt") {
+		t.Errorf("Upload() key = %q, want the file name as its last part", key)
+	}
+	objectPath := "/" + testS3Bucket + "/" + key
+	if data, _ := server.object(objectPath); !bytes.Equal(data, content) {
+		t.Errorf("stored object = %q, want %q", data, content)
+	}
+
+	if err := s.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.object(objectPath); ok {
+		t.Error("object is not deleted")
+	}
+}
+
+func TestS3StoragePresign(t *testing.T) {
+	srv, _ := startS3Server(t)
+	s := newTestS3Storage(t, srv.URL)
+	content := []byte("file content")
+	key, err := s.Upload(context.Background(), "file.bin", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := s.Link(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if got := query.Get("X-Amz-Expires"); got != "3600" {
+		t.Errorf("X-Amz-Expires = %q, want %q", got, "3600")
+	}
+	if got := query.Get("X-Amz-SignedHeaders"); got != "host" {
+		t.Errorf("X-Amz-SignedHeaders = %q, want %q", got, "host")
+	}
+	if len(query.Get("X-Amz-Signature")) != sha256.Size*2 {
+		t.Errorf("X-Amz-Signature = %q, want a hex SHA-256 HMAC", query.Get("X-Amz-Signature"))
+	}
+
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(data, content) {
+		t.Errorf("GET presigned link = %s %q, want 200 %q", resp.Status, data, content)
+	}
+
+	// links whose expiration is changed are rejected
+	query.Set("X-Amz-Expires", "7200")
+	u.RawQuery = query.Encode()
+	server := &testS3Server{t: t}
+	req := httptest.NewRequest(http.MethodGet, u.String(), nil)
+	req.Host = u.Host
+	if server.checkPresigned(req) == "" {
+		t.Error("changed presigned link is accepted")
+	}
+}
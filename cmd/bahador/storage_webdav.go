@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/thehxdev/bahador/utils"
+)
+
+const (
+	webdavUrlEnvVar      string = "BAHADOR_WEBDAV_URL"
+	webdavUserEnvVar     string = "BAHADOR_WEBDAV_USER"
+	webdavPasswordEnvVar string = "BAHADOR_WEBDAV_PASSWORD"
+	// public url of the WebDAV collection, if users download from another address
+	webdavLinkUrlEnvVar string = "BAHADOR_WEBDAV_LINK_URL"
+)
+
+// Stores files in a collection of a WebDAV server. Links are urls of the files
+// under the link url, which the server (or a proxy in front of it) must serve.
+type webdavStorage struct {
+	baseUrl  *url.URL
+	linkUrl  *url.URL
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newWebDAVStorage() (*webdavStorage, error) {
+	baseUrl, err := parseStorageUrl(webdavUrlEnvVar, utils.GetNonEmptyEnv(webdavUrlEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	linkUrl := baseUrl
+	if v := os.Getenv(webdavLinkUrlEnvVar); v != "" {
+		if linkUrl, err = parseStorageUrl(webdavLinkUrlEnvVar, v); err != nil {
+			return nil, err
+		}
+	}
+	return &webdavStorage{
+		baseUrl:  baseUrl,
+		linkUrl:  linkUrl,
+		user:     os.Getenv(webdavUserEnvVar),
+		password: os.Getenv(webdavPasswordEnvVar),
+		client:   newStorageClient(),
+	}, nil
+}
+
+func (s *webdavStorage) Upload(ctx context.Context, name string, r io.Reader, size int64) (string, error) {
+	dir := newStorageDir()
+	// files are put in their own collection, which must be created first
+	if err := s.do(ctx, "MKCOL", s.baseUrl.JoinPath(dir).String()+"/", nil, 0); err != nil {
+		return "", err
+	}
+	if err := s.do(ctx, http.MethodPut, s.baseUrl.JoinPath(dir, name).String(), r, size); err != nil {
+		return "", err
+	}
+	return dir + "/" + name, nil
+}
+
+func (s *webdavStorage) Link(ctx context.Context, id string) (string, error) {
+	return s.linkUrl.JoinPath(id).String(), nil
+}
+
+// Deletes the directory of the file.
+func (s *webdavStorage) Delete(ctx context.Context, id string) error {
+	return s.do(ctx, http.MethodDelete, s.baseUrl.JoinPath(storageFileDir(id)).String()+"/", nil, 0)
+}
+
+func (s *webdavStorage) MaxFileSize() int64 {
+	return 0
+}
+
+func (s *webdavStorage) do(ctx context.Context, method, u string, body io.Reader, size int64) error {
+	if body != nil {
+		body = io.NopCloser(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		// already deleted
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webdav %s failed: %s", method, resp.Status)
+	}
+	return nil
+}
+
+func parseStorageUrl(envVar, v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid %s: must be an http(s) url", envVar)
+	}
+	return u, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thehxdev/bahador/db"
+	"github.com/thehxdev/telbot"
+)
+
+const (
+	// how often the watcher looks for watches to check
+	watcherInterval      = time.Minute
+	defaultWatchInterval = time.Hour
+	minWatchInterval     = 5 * time.Minute
+	watchCheckTimeout    = time.Minute
+	// watches that each user can have, admins have no limit
+	maxUserWatches = 10
+	// watches that are checked at the same time
+	watchCheckers = 4
+)
+
+// Creates the job that downloads a watched URL. Credential profiles and proxy
+// rules apply like they do to links messages.
+func (app *App) newWatchJob(userId int, link string) (dlJob, error) {
+	job, err := app.newLinkJob(userId, link)
+	if err != nil {
+		return dlJob{}, err
+	}
+	if _, ok := job.source.(*httpSource); !ok {
+		return dlJob{}, ErrUnwatchableUrl
+	}
+	return job, nil
+}
+
+func (app *App) checkWatchedFile(ctx context.Context, job dlJob) (remoteFileInfo, error) {
+	ctx, cancel := context.WithTimeout(withJobProxy(ctx, job.proxy), watchCheckTimeout)
+	defer cancel()
+	return app.getRemoteFileInfo(ctx, job.url, job.header)
+}
+
+// Files without ETag, Last-Modified and size can't be watched.
+func watchable(info remoteFileInfo) bool {
+	return info.etag != "" || info.lastModified != "" || info.size != unknownFileSize
+}
+
+func watchChanged(w db.Watch, info remoteFileInfo) bool {
+	return info.etag != w.ETag || info.lastModified != w.LastModified || info.size != w.Size
+}
+
+// Checks watched files periodically and uploads the ones that are changed. Due
+// watches are checked by `watchCheckers` goroutines, and all of them are checked
+// before the next watches are due, so a watch is never checked twice at once.
+func (app *App) watcher(ctx context.Context) {
+	ticker := time.NewTicker(watcherInterval)
+	defer ticker.Stop()
+	for {
+		watches, err := app.DB.WatchesDue(time.Now().Unix())
+		if err != nil {
+			app.Log.Println(err)
+		}
+		wg := sync.WaitGroup{}
+		sem := make(chan struct{}, watchCheckers)
+		for _, w := range watches {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				app.checkWatch(ctx, w)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) checkWatch(ctx context.Context, w db.Watch) {
+	// users may be removed after creating a watch
+	if _, err := app.DB.UserAuthenticate(w.UserId); err != nil {
+		app.Log.Printf("watch #%d skipped: %v\n", w.Id, err)
+		return
+	}
+
+	w.CheckedAt = time.Now().Unix()
+	job, err := app.newWatchJob(w.UserId, w.Url)
+	if err != nil {
+		app.Log.Printf("watch #%d: %v\n", w.Id, err)
+		if err := app.DB.WatchUpdate(w); err != nil {
+			app.Log.Println(err)
+		}
+		return
+	}
+	info, err := app.checkWatchedFile(ctx, job)
+	if err != nil || !watchable(info) || !watchChanged(w, info) {
+		if err != nil {
+			app.Log.Printf("watch #%d: %v\n", w.Id, err)
+		}
+		if err := app.DB.WatchUpdate(w); err != nil {
+			app.Log.Println(err)
+		}
+		return
+	}
+
+	// the new state is saved first, so failed uploads are not repeated on every
+	// check. Users can retry them from the status message.
+	w.ETag, w.LastModified, w.Size = info.etag, info.lastModified, info.size
+	if err := app.DB.WatchUpdate(w); err != nil {
+		app.Log.Println(err)
+		return
+	}
+
+	msg, err := app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: w.ChatId,
+		Text:   fmt.Sprintf("Watched file #%d has changed:\n%s", w.Id, w.Url),
+	})
+	if err != nil {
+		app.Log.Println(err)
+		return
+	}
+	go app.runJob(w.ChatId, msg.Id, job)
+}
+
+// Usage: /watch <url> [interval]
+func (app *App) WatchAddHandler(update telbot.Update) error {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil
+	}
+	params := telbot.TextMessageParams{
+		ChatId:           update.ChatId(),
+		ReplyToMessageId: update.MessageId(),
+	}
+	args := strings.Fields(update.Message.Text)
+	interval := defaultWatchInterval
+	if len(args) == 3 {
+		interval, err = time.ParseDuration(args[2])
+	}
+	switch {
+	case len(args) != 2 && len(args) != 3:
+		params.Text = "Usage: /watch <url> [interval]"
+	case err != nil || interval < minWatchInterval:
+		params.Text = fmt.Sprintf("Interval must be a duration of at least %s (e.g. 6h).", minWatchInterval)
+	}
+	if params.Text != "" {
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+	if !u.IsAdmin {
+		n, err := app.DB.WatchCountByUser(u.UserId)
+		if err != nil {
+			return err
+		}
+		if n >= maxUserWatches {
+			params.Text = fmt.Sprintf("You can't have more than %d watches (see /watches and /unwatch).", maxUserWatches)
+			_, err = app.Bot.SendMessage(context.Background(), params)
+			return err
+		}
+	}
+
+	job, err := app.newWatchJob(update.UserId(), args[1])
+	if err != nil {
+		params.Text = err.Error()
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+	info, err := app.checkWatchedFile(context.Background(), job)
+	if err != nil {
+		app.Log.Println(err)
+		params.Text = userErrorText(err)
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+	if !watchable(info) {
+		params.Text = "Server does not send ETag, Last-Modified or size of the file. Its changes can't be detected."
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	// the current file is the baseline, only its changes are uploaded
+	id, err := app.DB.WatchInsert(db.Watch{
+		UserId:       update.UserId(),
+		ChatId:       update.ChatId(),
+		Url:          job.url,
+		Interval:     int64(interval / time.Second),
+		ETag:         info.etag,
+		LastModified: info.lastModified,
+		Size:         info.size,
+		CheckedAt:    time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	params.Text = fmt.Sprintf("Watch #%d created. The file is checked every %s and uploaded when it changes.", id, interval)
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
+
+// Lists watches of the user, or all of them for admins.
+func (app *App) WatchListHandler(update telbot.Update) error {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil
+	}
+	var watches []db.Watch
+	if u.IsAdmin {
+		watches, err = app.DB.WatchList()
+	} else {
+		watches, err = app.DB.WatchesByUser(u.UserId)
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	for _, w := range watches {
+		line := fmt.Sprintf("#%d every %s: %s", w.Id, time.Duration(w.Interval)*time.Second, w.Url)
+		if u.IsAdmin && w.UserId != u.UserId {
+			line += fmt.Sprintf(" (user %d)", w.UserId)
+		}
+		lines = append(lines, line)
+	}
+	text := "No watches."
+	if len(lines) > 0 {
+		text = strings.Join(lines, "\n")
+	}
+	_, err = app.Bot.SendMessage(context.Background(), telbot.TextMessageParams{
+		ChatId: update.ChatId(),
+		Text:   text,
+	})
+	return err
+}
+
+// Usage: /unwatch <id>
+func (app *App) WatchDeleteHandler(update telbot.Update) error {
+	u, err := app.DB.UserAuthenticate(update.UserId())
+	if err != nil {
+		return nil
+	}
+	params := telbot.TextMessageParams{ChatId: update.ChatId()}
+	args := strings.Fields(update.Message.Text)
+	var id int64
+	if len(args) == 2 {
+		id, err = strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+	}
+	if len(args) != 2 || err != nil {
+		params.Text = "Usage: /unwatch <id>"
+		_, err = app.Bot.SendMessage(context.Background(), params)
+		return err
+	}
+
+	w, err := app.DB.WatchGet(id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && w.UserId != u.UserId && !u.IsAdmin):
+		params.Text = "Watch does not exist."
+	case err != nil:
+		return err
+	default:
+		if _, err := app.DB.WatchDelete(id); err != nil {
+			return err
+		}
+		params.Text = fmt.Sprintf("Watch #%d deleted.", id)
+	}
+	_, err = app.Bot.SendMessage(context.Background(), params)
+	return err
+}
@@ -0,0 +1,44 @@
+package db
+
+// Checkpoints keep the progress of jobs that were stopped by a shutdown. They
+// belong to the scheduled jobs that continue them.
+func (db *DB) JobCheckpointInsert(jobId int64, progress string) error {
+	stmt := `INSERT INTO job_checkpoints (job_id, progress) VALUES (?, ?)`
+	_, err := db.Write.Exec(stmt, jobId, progress)
+	return err
+}
+
+func (db *DB) JobCheckpointGet(jobId int64) (string, error) {
+	var progress string
+	stmt := `SELECT progress FROM job_checkpoints WHERE job_id = ?`
+	err := db.Read.QueryRow(stmt, jobId).Scan(&progress)
+	return progress, err
+}
+
+func (db *DB) JobCheckpointList() ([]string, error) {
+	stmt := `SELECT progress FROM job_checkpoints`
+	rows, err := db.Read.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checkpoints := []string{}
+	for rows.Next() {
+		var progress string
+		if err := rows.Scan(&progress); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, progress)
+	}
+	return checkpoints, rows.Err()
+}
+
+func (db *DB) JobCheckpointDelete(jobId int64) (bool, error) {
+	stmt := `DELETE FROM job_checkpoints WHERE job_id = ?`
+	res, err := db.Write.Exec(stmt, jobId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,51 @@
+package db
+
+type Credential struct {
+	Name    string
+	Host    string
+	Headers []byte
+	UserId  int
+}
+
+func (db *DB) CredentialInsert(cred Credential) error {
+	stmt := `INSERT OR REPLACE INTO credentials (name, host, headers, user_id) VALUES (?, ?, ?, ?)`
+	_, err := db.Write.Exec(stmt, cred.Name, cred.Host, cred.Headers, cred.UserId)
+	return err
+}
+
+func (db *DB) CredentialsByHost(host string) ([]Credential, error) {
+	stmt := `SELECT name, host, headers, user_id FROM credentials WHERE host = ? ORDER BY name`
+	return db.credentialsQuery(stmt, host)
+}
+
+func (db *DB) CredentialList() ([]Credential, error) {
+	stmt := `SELECT name, host, headers, user_id FROM credentials ORDER BY host, name`
+	return db.credentialsQuery(stmt)
+}
+
+func (db *DB) CredentialDelete(name string) (bool, error) {
+	stmt := `DELETE FROM credentials WHERE name = ?`
+	res, err := db.Write.Exec(stmt, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) credentialsQuery(stmt string, args ...any) ([]Credential, error) {
+	rows, err := db.Read.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	creds := []Credential{}
+	for rows.Next() {
+		c := Credential{}
+		if err := rows.Scan(&c.Name, &c.Host, &c.Headers, &c.UserId); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
@@ -9,3 +9,24 @@ type File struct {
 	MessageId    int
 	UserId       int
 }
+
+// Telegram gives the same unique id to identical files, so the row of an
+// uploaded file points to its latest message.
+func (db *DB) FileInsert(f File) error {
+	stmt := `INSERT INTO files (file_id, file_unique_id, file_name, file_size, message_id, user_id) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(file_unique_id) DO UPDATE SET file_id = excluded.file_id, file_name = excluded.file_name,
+		file_size = excluded.file_size, message_id = excluded.message_id, user_id = excluded.user_id`
+	_, err := db.Write.Exec(stmt, f.FileId, f.FileUniqueId, f.FileName, f.FileSize, f.MessageId, f.UserId)
+	return err
+}
+
+// Deletes the file of the message, unless it's uploaded again by a newer message.
+func (db *DB) FileDeleteByMessage(messageId int) (bool, error) {
+	stmt := `DELETE FROM files WHERE message_id = ?`
+	res, err := db.Write.Exec(stmt, messageId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
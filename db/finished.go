@@ -0,0 +1,79 @@
+package db
+
+// Jobs that uploaded their files, kept so their links can be revoked and their
+// files deleted.
+type FinishedJob struct {
+	Id       int64
+	UserId   int
+	CacheKey string
+	// unix time
+	Date int64
+	// ids of the files in the storage
+	FileIds []string
+}
+
+func (db *DB) FinishedJobInsert(j FinishedJob) (int64, error) {
+	tx, err := db.Write.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt := `INSERT INTO finished_jobs (user_id, cache_key, date) VALUES (?, ?, ?)`
+	res, err := tx.Exec(stmt, j.UserId, j.CacheKey, j.Date)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, fileId := range j.FileIds {
+		if _, err := tx.Exec(`INSERT INTO job_files (job_id, file_id) VALUES (?, ?)`, id, fileId); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (db *DB) FinishedJobGet(id int64) (*FinishedJob, error) {
+	stmt := `SELECT id, user_id, cache_key, date FROM finished_jobs WHERE id = ?`
+	j := &FinishedJob{}
+	if err := db.Read.QueryRow(stmt, id).Scan(&j.Id, &j.UserId, &j.CacheKey, &j.Date); err != nil {
+		return nil, err
+	}
+	rows, err := db.Read.Query(`SELECT file_id FROM job_files WHERE job_id = ? ORDER BY rowid`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	j.FileIds = []string{}
+	for rows.Next() {
+		var fileId string
+		if err := rows.Scan(&fileId); err != nil {
+			return nil, err
+		}
+		j.FileIds = append(j.FileIds, fileId)
+	}
+	return j, rows.Err()
+}
+
+// Deletes the job and its list of files.
+func (db *DB) FinishedJobDelete(id int64) (bool, error) {
+	tx, err := db.Write.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM job_files WHERE job_id = ?`, id); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`DELETE FROM finished_jobs WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
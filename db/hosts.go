@@ -0,0 +1,62 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type HostRule struct {
+	Host  string
+	Allow bool
+}
+
+func (db *DB) HostRuleInsert(rule HostRule) error {
+	stmt := `INSERT OR REPLACE INTO host_rules (host, allow) VALUES (?, ?)`
+	_, err := db.Write.Exec(stmt, rule.Host, rule.Allow)
+	return err
+}
+
+func (db *DB) HostRuleList() ([]HostRule, error) {
+	stmt := `SELECT host, allow FROM host_rules ORDER BY allow DESC, host`
+	rows, err := db.Read.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []HostRule{}
+	for rows.Next() {
+		r := HostRule{}
+		if err := rows.Scan(&r.Host, &r.Allow); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (db *DB) HostRuleDelete(host string) (bool, error) {
+	stmt := `DELETE FROM host_rules WHERE host = ?`
+	res, err := db.Write.Exec(stmt, host)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Returns the most specific rule that matches host or one of its parent
+// domains. Returns nil if no rule matches.
+func (db *DB) HostRuleForHost(host string) (*HostRule, error) {
+	stmt := `SELECT host, allow FROM host_rules WHERE host = ?`
+	for _, domain := range DomainCandidates(host) {
+		r := &HostRule{}
+		err := db.Read.QueryRow(stmt, domain).Scan(&r.Host, &r.Allow)
+		if err == nil {
+			return r, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,63 @@
+package db
+
+// Signed links of stored files that the bot's HTTP server serves.
+type Link struct {
+	Id     int64
+	UserId int
+	FileId string
+	// unix time
+	ExpiresAt int64
+	// zero is unlimited
+	MaxDownloads int
+	Downloads    int
+}
+
+func (db *DB) LinkInsert(l Link) (int64, error) {
+	stmt := `INSERT INTO links (user_id, file_id, expires_at, max_downloads) VALUES (?, ?, ?, ?)`
+	res, err := db.Write.Exec(stmt, l.UserId, l.FileId, l.ExpiresAt, l.MaxDownloads)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (db *DB) LinkGet(id int64) (*Link, error) {
+	stmt := `SELECT id, user_id, file_id, expires_at, max_downloads, downloads FROM links WHERE id = ?`
+	l := &Link{}
+	err := db.Read.QueryRow(stmt, id).Scan(&l.Id, &l.UserId, &l.FileId, &l.ExpiresAt, &l.MaxDownloads, &l.Downloads)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Counts a download of the link. Returns false if the link has no downloads left.
+func (db *DB) LinkCountDownload(id int64) (bool, error) {
+	stmt := `UPDATE links SET downloads = downloads + 1 WHERE id = ? AND (max_downloads = 0 OR downloads < max_downloads)`
+	res, err := db.Write.Exec(stmt, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Deletes links that expired before `now` (unix time).
+func (db *DB) LinksDeleteExpired(now int64) (int64, error) {
+	stmt := `DELETE FROM links WHERE expires_at < ?`
+	res, err := db.Write.Exec(stmt, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Deletes the links of a stored file, which makes the server reject them.
+func (db *DB) LinksDeleteByFile(fileId string) (int64, error) {
+	stmt := `DELETE FROM links WHERE file_id = ?`
+	res, err := db.Write.Exec(stmt, fileId)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
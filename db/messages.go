@@ -6,3 +6,19 @@ type Message struct {
 	UserId    int
 	ChatId    int
 }
+
+func (db *DB) MessageInsert(m Message) error {
+	stmt := `INSERT OR IGNORE INTO messages (message_id, date, user_id, chat_id) VALUES (?, ?, ?, ?)`
+	_, err := db.Write.Exec(stmt, m.MessageId, m.Date, m.UserId, m.ChatId)
+	return err
+}
+
+func (db *DB) MessageDelete(messageId int) (bool, error) {
+	stmt := `DELETE FROM messages WHERE message_id = ?`
+	res, err := db.Write.Exec(stmt, messageId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
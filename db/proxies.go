@@ -0,0 +1,142 @@
+package db
+
+import (
+	"net/netip"
+	"strings"
+)
+
+type Proxy struct {
+	Name string
+	Url  string
+}
+
+type ProxyRule struct {
+	Domain    string
+	ProxyName string
+}
+
+// Rules that use the proxy are kept when its url is changed.
+func (db *DB) ProxyInsert(proxy Proxy) error {
+	stmt := `INSERT INTO proxies (name, url) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET url = excluded.url`
+	_, err := db.Write.Exec(stmt, proxy.Name, proxy.Url)
+	return err
+}
+
+func (db *DB) ProxyGet(name string) (*Proxy, error) {
+	p := &Proxy{Name: name}
+	stmt := `SELECT url FROM proxies WHERE name = ?`
+	if err := db.Read.QueryRow(stmt, name).Scan(&p.Url); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (db *DB) ProxyList() ([]Proxy, error) {
+	stmt := `SELECT name, url FROM proxies ORDER BY name`
+	rows, err := db.Read.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	proxies := []Proxy{}
+	for rows.Next() {
+		p := Proxy{}
+		if err := rows.Scan(&p.Name, &p.Url); err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, rows.Err()
+}
+
+// Deletes the proxy and all rules that use it.
+func (db *DB) ProxyDelete(name string) (bool, error) {
+	tx, err := db.Write.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM proxy_rules WHERE proxy_name = ?`, name); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`DELETE FROM proxies WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+func (db *DB) ProxyRuleInsert(rule ProxyRule) error {
+	stmt := `INSERT OR REPLACE INTO proxy_rules (domain, proxy_name) VALUES (?, ?)`
+	_, err := db.Write.Exec(stmt, rule.Domain, rule.ProxyName)
+	return err
+}
+
+func (db *DB) ProxyRuleList() ([]ProxyRule, error) {
+	stmt := `SELECT domain, proxy_name FROM proxy_rules ORDER BY domain`
+	rows, err := db.Read.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []ProxyRule{}
+	for rows.Next() {
+		r := ProxyRule{}
+		if err := rows.Scan(&r.Domain, &r.ProxyName); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (db *DB) ProxyRuleDelete(domain string) (bool, error) {
+	stmt := `DELETE FROM proxy_rules WHERE domain = ?`
+	res, err := db.Write.Exec(stmt, domain)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Returns the proxy urls of all rules, by domain.
+func (db *DB) ProxyRuleUrls() (map[string]string, error) {
+	stmt := `SELECT r.domain, p.url FROM proxy_rules r JOIN proxies p ON r.proxy_name = p.name`
+	rows, err := db.Read.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	urls := map[string]string{}
+	for rows.Next() {
+		var domain, url string
+		if err := rows.Scan(&domain, &url); err != nil {
+			return nil, err
+		}
+		urls[domain] = url
+	}
+	return urls, rows.Err()
+}
+
+// Returns host and its parent domains, from the most specific one.
+// IP addresses only match themselves.
+func DomainCandidates(host string) []string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{host}
+	}
+	domains := []string{}
+	for {
+		domains = append(domains, host)
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return domains
+		}
+		host = parent
+	}
+}
@@ -0,0 +1,74 @@
+package db
+
+type ScheduledJob struct {
+	Id        int64
+	UserId    int
+	ChatId    int
+	MessageId int
+	// unix time
+	RunAt   int64
+	Message []byte
+	Answer  string
+}
+
+func (db *DB) ScheduledJobInsert(job ScheduledJob) (int64, error) {
+	stmt := `INSERT INTO scheduled_jobs (user_id, chat_id, message_id, run_at, message, answer) VALUES (?, ?, ?, ?, ?, ?)`
+	res, err := db.Write.Exec(stmt, job.UserId, job.ChatId, job.MessageId, job.RunAt, job.Message, job.Answer)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (db *DB) ScheduledJobGet(id int64) (*ScheduledJob, error) {
+	j := &ScheduledJob{Id: id}
+	stmt := `SELECT user_id, chat_id, message_id, run_at, message, answer FROM scheduled_jobs WHERE id = ?`
+	err := db.Read.QueryRow(stmt, id).Scan(&j.UserId, &j.ChatId, &j.MessageId, &j.RunAt, &j.Message, &j.Answer)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (db *DB) ScheduledJobsByUser(userId int) ([]ScheduledJob, error) {
+	stmt := `SELECT id, user_id, chat_id, message_id, run_at, message, answer FROM scheduled_jobs WHERE user_id = ? ORDER BY run_at, id`
+	return db.scheduledJobsQuery(stmt, userId)
+}
+
+func (db *DB) ScheduledJobList() ([]ScheduledJob, error) {
+	stmt := `SELECT id, user_id, chat_id, message_id, run_at, message, answer FROM scheduled_jobs ORDER BY run_at, id`
+	return db.scheduledJobsQuery(stmt)
+}
+
+// Returns jobs that should start at or before `now` (unix time).
+func (db *DB) ScheduledJobsDue(now int64) ([]ScheduledJob, error) {
+	stmt := `SELECT id, user_id, chat_id, message_id, run_at, message, answer FROM scheduled_jobs WHERE run_at <= ? ORDER BY run_at, id`
+	return db.scheduledJobsQuery(stmt, now)
+}
+
+func (db *DB) ScheduledJobDelete(id int64) (bool, error) {
+	stmt := `DELETE FROM scheduled_jobs WHERE id = ?`
+	res, err := db.Write.Exec(stmt, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) scheduledJobsQuery(stmt string, args ...any) ([]ScheduledJob, error) {
+	rows, err := db.Read.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []ScheduledJob{}
+	for rows.Next() {
+		j := ScheduledJob{}
+		if err := rows.Scan(&j.Id, &j.UserId, &j.ChatId, &j.MessageId, &j.RunAt, &j.Message, &j.Answer); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,61 @@
+package db
+
+type SSHCredential struct {
+	UserId   int
+	Host     string
+	Username string
+	Secret   []byte
+	HostKey  string
+}
+
+// Inserts the credential or replaces the secret of an existing one. Saved host
+// keys are kept, so servers can't be swapped by updating the secret.
+func (db *DB) SSHCredentialInsert(cred SSHCredential) error {
+	stmt := `INSERT INTO ssh_credentials (user_id, host, username, secret) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, host, username) DO UPDATE SET secret = excluded.secret`
+	_, err := db.Write.Exec(stmt, cred.UserId, cred.Host, cred.Username, cred.Secret)
+	return err
+}
+
+func (db *DB) SSHCredentialGet(userId int, host, username string) (*SSHCredential, error) {
+	c := &SSHCredential{UserId: userId, Host: host, Username: username}
+	stmt := `SELECT secret, host_key FROM ssh_credentials WHERE user_id = ? AND host = ? AND username = ?`
+	if err := db.Read.QueryRow(stmt, userId, host, username).Scan(&c.Secret, &c.HostKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (db *DB) SSHCredentialSetHostKey(userId int, host, username, hostKey string) error {
+	stmt := `UPDATE ssh_credentials SET host_key = ? WHERE user_id = ? AND host = ? AND username = ?`
+	_, err := db.Write.Exec(stmt, hostKey, userId, host, username)
+	return err
+}
+
+func (db *DB) SSHCredentialList(userId int) ([]SSHCredential, error) {
+	stmt := `SELECT host, username, host_key FROM ssh_credentials WHERE user_id = ? ORDER BY host, username`
+	rows, err := db.Read.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	creds := []SSHCredential{}
+	for rows.Next() {
+		c := SSHCredential{UserId: userId}
+		if err := rows.Scan(&c.Host, &c.Username, &c.HostKey); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+func (db *DB) SSHCredentialDelete(userId int, host, username string) (bool, error) {
+	stmt := `DELETE FROM ssh_credentials WHERE user_id = ? AND host = ? AND username = ?`
+	res, err := db.Write.Exec(stmt, userId, host, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
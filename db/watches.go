@@ -0,0 +1,93 @@
+package db
+
+type Watch struct {
+	Id     int64
+	UserId int
+	ChatId int
+	Url    string
+	// seconds between checks
+	Interval     int64
+	ETag         string
+	LastModified string
+	Size         int64
+	// unix time
+	CheckedAt int64
+}
+
+const watchColumns = `id, user_id, chat_id, url, interval, etag, last_modified, size, checked_at`
+
+func (db *DB) WatchInsert(w Watch) (int64, error) {
+	stmt := `INSERT INTO watches (user_id, chat_id, url, interval, etag, last_modified, size, checked_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.Write.Exec(stmt, w.UserId, w.ChatId, w.Url, w.Interval, w.ETag, w.LastModified, w.Size, w.CheckedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (db *DB) WatchGet(id int64) (*Watch, error) {
+	stmt := `SELECT ` + watchColumns + ` FROM watches WHERE id = ?`
+	w := &Watch{}
+	err := db.Read.QueryRow(stmt, id).Scan(&w.Id, &w.UserId, &w.ChatId, &w.Url, &w.Interval, &w.ETag, &w.LastModified, &w.Size, &w.CheckedAt)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (db *DB) WatchesByUser(userId int) ([]Watch, error) {
+	stmt := `SELECT ` + watchColumns + ` FROM watches WHERE user_id = ? ORDER BY id`
+	return db.watchesQuery(stmt, userId)
+}
+
+func (db *DB) WatchList() ([]Watch, error) {
+	stmt := `SELECT ` + watchColumns + ` FROM watches ORDER BY id`
+	return db.watchesQuery(stmt)
+}
+
+func (db *DB) WatchCountByUser(userId int) (int, error) {
+	stmt := `SELECT COUNT(*) FROM watches WHERE user_id = ?`
+	var n int
+	err := db.Read.QueryRow(stmt, userId).Scan(&n)
+	return n, err
+}
+
+// Returns watches whose interval has passed since their last check at `now` (unix time).
+func (db *DB) WatchesDue(now int64) ([]Watch, error) {
+	stmt := `SELECT ` + watchColumns + ` FROM watches WHERE checked_at + interval <= ? ORDER BY checked_at`
+	return db.watchesQuery(stmt, now)
+}
+
+// Saves the state of the file at the last check.
+func (db *DB) WatchUpdate(w Watch) error {
+	stmt := `UPDATE watches SET etag = ?, last_modified = ?, size = ?, checked_at = ? WHERE id = ?`
+	_, err := db.Write.Exec(stmt, w.ETag, w.LastModified, w.Size, w.CheckedAt, w.Id)
+	return err
+}
+
+func (db *DB) WatchDelete(id int64) (bool, error) {
+	stmt := `DELETE FROM watches WHERE id = ?`
+	res, err := db.Write.Exec(stmt, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) watchesQuery(stmt string, args ...any) ([]Watch, error) {
+	rows, err := db.Read.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	watches := []Watch{}
+	for rows.Next() {
+		w := Watch{}
+		if err := rows.Scan(&w.Id, &w.UserId, &w.ChatId, &w.Url, &w.Interval, &w.ETag, &w.LastModified, &w.Size, &w.CheckedAt); err != nil {
+			return nil, err
+		}
+		watches = append(watches, w)
+	}
+	return watches, rows.Err()
+}
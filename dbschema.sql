@@ -1,9 +1,9 @@
-CREATE TABLE users (
+CREATE TABLE IF NOT EXISTS users (
     user_id BIGINT PRIMARY KEY,
     is_admin BOOLEAN NOT NULL CHECK(is_admin IN (0, 1))
 );
 
-CREATE TABLE messages (
+CREATE TABLE IF NOT EXISTS messages (
     message_id BIGINT PRIMARY KEY,
     -- date stored as unix time
     date UNSIGNED BIGINT NOT NULL,
@@ -12,7 +12,7 @@ CREATE TABLE messages (
     FOREIGN KEY(user_id) REFERENCES users(user_id)
 );
 
-CREATE TABLE files (
+CREATE TABLE IF NOT EXISTS files (
     id INTEGER PRIMARY KEY,
     file_id TEXT NOT NULL,
     file_unique_id TEXT UNIQUE NOT NULL,
@@ -23,3 +23,113 @@ CREATE TABLE files (
     FOREIGN KEY(message_id) REFERENCES messages(message_id),
     FOREIGN KEY(user_id) REFERENCES users(user_id)
 );
+
+CREATE TABLE IF NOT EXISTS credentials (
+    name TEXT PRIMARY KEY,
+    host TEXT NOT NULL,
+    -- http header lines encrypted with the bot's secret key
+    headers BLOB NOT NULL,
+    user_id BIGINT NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS proxies (
+    name TEXT PRIMARY KEY,
+    url TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS proxy_rules (
+    -- requests to this domain and its subdomains use the proxy
+    domain TEXT PRIMARY KEY,
+    proxy_name TEXT NOT NULL,
+    FOREIGN KEY(proxy_name) REFERENCES proxies(name) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS host_rules (
+    -- rules apply to the host and its subdomains
+    host TEXT PRIMARY KEY,
+    allow BOOLEAN NOT NULL CHECK(allow IN (0, 1))
+);
+
+CREATE TABLE IF NOT EXISTS ssh_credentials (
+    user_id BIGINT NOT NULL,
+    -- host:port
+    host TEXT NOT NULL,
+    username TEXT NOT NULL,
+    -- password or private key encrypted with the bot's secret key
+    secret BLOB NOT NULL,
+    -- server's public key in authorized_keys format, saved on first connection
+    host_key TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY(user_id, host, username),
+    FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+    id INTEGER PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    chat_id BIGINT NOT NULL,
+    -- message that the status of the job replies to
+    message_id BIGINT NOT NULL,
+    -- start time stored as unix time
+    run_at BIGINT NOT NULL,
+    -- links message of the job encrypted with the bot's secret key
+    message BLOB NOT NULL,
+    -- answer to the question of the job (e.g. selected files of a torrent)
+    answer TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS watches (
+    id INTEGER PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    chat_id BIGINT NOT NULL,
+    url TEXT NOT NULL,
+    -- seconds between checks
+    interval BIGINT NOT NULL,
+    -- state of the file at the last check
+    etag TEXT NOT NULL DEFAULT '',
+    last_modified TEXT NOT NULL DEFAULT '',
+    size BIGINT NOT NULL DEFAULT -1,
+    -- unix time of the last check
+    checked_at BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS job_checkpoints (
+    -- scheduled job that continues the checkpointed job
+    job_id INTEGER PRIMARY KEY,
+    -- progress of the job as JSON
+    progress TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS links (
+    id INTEGER PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    -- id of the file in the storage
+    file_id TEXT NOT NULL,
+    -- expiration stored as unix time
+    expires_at BIGINT NOT NULL,
+    -- zero is unlimited
+    max_downloads INTEGER NOT NULL DEFAULT 0,
+    downloads INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS finished_jobs (
+    -- users revoke links and delete files of jobs by this id, so ids of
+    -- deleted jobs are not reused
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id BIGINT NOT NULL,
+    -- key of the downloaded file in the cache, empty if it's not cached
+    cache_key TEXT NOT NULL DEFAULT '',
+    -- date stored as unix time
+    date BIGINT NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(user_id)
+);
+
+CREATE TABLE IF NOT EXISTS job_files (
+    job_id INTEGER NOT NULL,
+    -- id of the file in the storage
+    file_id TEXT NOT NULL,
+    FOREIGN KEY(job_id) REFERENCES finished_jobs(id)
+);
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+var ErrInvalidBencode = errors.New("invalid bencoded data")
+
+// Decodes bencoded data (the format of .torrent files). Integers are returned as
+// int64, byte strings as string, lists as []any and dictionaries as map[string]any.
+func BencodeDecode(data []byte) (any, error) {
+	v, rest, err := bdecode(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrInvalidBencode
+	}
+	return v, nil
+}
+
+// nested lists and dictionaries deeper than this are rejected
+const maxBencodeDepth int = 64
+
+func bdecode(data []byte, depth int) (any, []byte, error) {
+	if len(data) == 0 || depth > maxBencodeDepth {
+		return nil, nil, ErrInvalidBencode
+	}
+	switch c := data[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return nil, nil, ErrInvalidBencode
+		}
+		n, err := strconv.ParseInt(string(data[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, ErrInvalidBencode
+		}
+		return n, data[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return nil, nil, ErrInvalidBencode
+		}
+		n, err := strconv.Atoi(string(data[:colon]))
+		if err != nil || n < 0 || n > len(data)-colon-1 {
+			return nil, nil, ErrInvalidBencode
+		}
+		start := colon + 1
+		return string(data[start : start+n]), data[start+n:], nil
+	case c == 'l':
+		list := []any{}
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			v, rest, err := bdecode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+			data = rest
+		}
+		if len(data) == 0 {
+			return nil, nil, ErrInvalidBencode
+		}
+		return list, data[1:], nil
+	case c == 'd':
+		dict := map[string]any{}
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			k, rest, err := bdecode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, ErrInvalidBencode
+			}
+			v, rest, err := bdecode(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[key] = v
+			data = rest
+		}
+		if len(data) == 0 {
+			return nil, nil, ErrInvalidBencode
+		}
+		return dict, data[1:], nil
+	}
+	return nil, nil, ErrInvalidBencode
+}
+
+// Bencoded data that is written as is by BencodeEncode.
+type BencodeRaw []byte
+
+// Returns the bencoded values of the keys of a dictionary, without decoding them.
+func BencodeRawDict(data []byte) (map[string][]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, ErrInvalidBencode
+	}
+	dict := map[string][]byte{}
+	rest := data[1:]
+	for len(rest) > 0 && rest[0] != 'e' {
+		k, after, err := bdecode(rest, 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, ErrInvalidBencode
+		}
+		_, next, err := bdecode(after, 1)
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = after[:len(after)-len(next)]
+		rest = next
+	}
+	if len(rest) != 1 {
+		return nil, ErrInvalidBencode
+	}
+	return dict, nil
+}
+
+// Encodes int64, string, BencodeRaw, []any and map[string]any values. Keys of
+// dictionaries are sorted, as the format requires.
+func BencodeEncode(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := bencode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencode(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int64:
+		buf.WriteString("i" + strconv.FormatInt(v, 10) + "e")
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)) + ":" + v)
+	case BencodeRaw:
+		buf.Write(v)
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := bencode(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencode(buf, k)
+			if err := bencode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return errors.New("unsupported bencode value")
+	}
+	return nil
+}
@@ -5,12 +5,14 @@ import (
 	"math/big"
 )
 
+// Returns a random number in [low, high] range.
 func GenRandInt64(low, high int64) (int64, error) {
-	delta := high - low + 1
-	n := big.NewInt(delta)
-	randNum, err := rand.Int(rand.Reader, n)
+	// high - low + 1 overflows int64 for the full range
+	delta := new(big.Int).Sub(big.NewInt(high), big.NewInt(low))
+	delta.Add(delta, big.NewInt(1))
+	randNum, err := rand.Int(rand.Reader, delta)
 	if err != nil {
 		return 0, err
 	}
-	return randNum.Int64(), nil
+	return randNum.Int64() + low, nil
 }
@@ -21,15 +21,21 @@ func GetNonEmptyEnv(key string) string {
 	return v
 }
 
-func CopyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (written int64, err error) {
-	errChan := make(chan error, 1)
+func CopyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	type copyResult struct {
+		written int64
+		err     error
+	}
+	// the copy may still be running after ctx is done, so it must not share
+	// variables with the caller
+	resChan := make(chan copyResult, 1)
 	go func() {
-		written, err = io.Copy(dst, src)
-		errChan <- err
+		written, err := io.Copy(dst, src)
+		resChan <- copyResult{written, err}
 	}()
 	select {
-	case <-errChan:
-		return written, err
+	case res := <-resChan:
+		return res.written, res.err
 	case <-ctx.Done():
 		return 0, ctx.Err()
 	}